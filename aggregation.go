@@ -0,0 +1,166 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Aggregation of allocations whose labels are identical.
+//
+// When the configured labels do not uniquely identify an allocation (ex. only
+// "namespace" is exported from a pod-level query), several allocations map to
+// the same series. Their values are aggregated using a per-metric aggregation
+// function, rather than overwritten.
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// Aggregation functions.
+const (
+	// Sum of values (ex. costs).
+	AggregationSum = "sum"
+	// Average of values, weighted by the minutes of each allocation (ex.
+	// efficiencies).
+	AggregationAvg = "avg"
+	// Maximum of values (ex. peaks).
+	AggregationMax = "max"
+)
+
+// Get the default aggregation function of an Allocation field.
+//
+// Efficiencies are averaged and minutes are maximized, since allocations
+// with identical labels usually run concurrently. All other fields are
+// summed.
+func DefaultAggregation(field string) string {
+	switch {
+	case strings.HasSuffix(field, "Efficiency"):
+		return AggregationAvg
+	case field == "Minutes":
+		return AggregationMax
+	default:
+		return AggregationSum
+	}
+}
+
+// Get aggregation functions from configuration by Allocation field name.
+//
+// Each element in "metrics.names" may set an "aggregation" key to one of
+// "sum", "avg" or "max". Fields without a valid aggregation function default
+// to DefaultAggregation.
+func GetAggregations(v *viper.Viper) map[string]string {
+	ns, _ := v.Get("metrics.names").([]any)
+	fns := make(map[string]string, len(ns))
+	for _, n := range ns {
+		m := n.(map[string]any)
+		field := GetElementOrZeroValue[string]("field", m)
+		fn := strings.ToLower(GetElementOrZeroValue[string]("aggregation", m))
+		switch fn {
+		case AggregationSum, AggregationAvg, AggregationMax:
+		case "":
+			fn = DefaultAggregation(field)
+		default:
+			logger.Printf("Invalid aggregation '%s' for field '%s'. Defaulting to %s\n", fn, field, DefaultAggregation(field))
+			fn = DefaultAggregation(field)
+		}
+		fns[field] = fn
+	}
+	return fns
+}
+
+// An Aggregator aggregates the values of allocations by label set.
+type Aggregator struct {
+	fns        map[string]string
+	fields     []string
+	index      map[string]int
+	aggregates []*aggregate
+	// Number of allocations whose label set matched that of a previous
+	// allocation.
+	Collisions int
+}
+
+// Intermediate values of a label set.
+type aggregate struct {
+	set     *LabelSetValues
+	count   int
+	minutes float64
+	// Unweighted sums of "avg" fields, used if the minutes of all allocations
+	// are 0.
+	sums map[string]float64
+}
+
+// Create a new Aggregator of the given fields using the aggregation functions
+// by field name. Fields without an aggregation function default to
+// DefaultAggregation.
+func NewAggregator(fns map[string]string, fields []string) *Aggregator {
+	return &Aggregator{
+		fns:    fns,
+		fields: fields,
+		index:  map[string]int{},
+	}
+}
+
+// Get the aggregation function of a field.
+func (g *Aggregator) fn(field string) string {
+	if fn, ok := g.fns[field]; ok {
+		return fn
+	}
+	return DefaultAggregation(field)
+}
+
+// Add an allocation with the given labels. Returns true if the label set
+// matched that of a previous allocation.
+func (g *Aggregator) Add(ls prometheus.Labels, a Allocation) bool {
+	k := GetLabelsKey(ls)
+	i, collision := g.index[k]
+	if !collision {
+		i = len(g.aggregates)
+		g.index[k] = i
+		g.aggregates = append(g.aggregates, &aggregate{
+			set:  &LabelSetValues{Labels: ls, Values: map[string]float64{}},
+			sums: map[string]float64{},
+		})
+	} else {
+		g.Collisions++
+	}
+	agg := g.aggregates[i]
+	for _, f := range g.fields {
+		x := a.GetValueByFieldNameFloat(f)
+		switch g.fn(f) {
+		case AggregationAvg:
+			agg.set.Values[f] += x * a.Minutes
+			agg.sums[f] += x
+		case AggregationMax:
+			if agg.count == 0 || x > agg.set.Values[f] {
+				agg.set.Values[f] = x
+			}
+		default:
+			agg.set.Values[f] += x
+		}
+	}
+	agg.count++
+	agg.minutes += a.Minutes
+	return collision
+}
+
+// Get the aggregated values by label set, in the order in which label sets
+// were first added.
+func (g *Aggregator) Sets() []*LabelSetValues {
+	sets := make([]*LabelSetValues, len(g.aggregates))
+	for i, agg := range g.aggregates {
+		set := &LabelSetValues{Labels: agg.set.Labels, Values: make(map[string]float64, len(agg.set.Values)), Minutes: agg.minutes}
+		for f, x := range agg.set.Values {
+			if g.fn(f) == AggregationAvg {
+				if agg.minutes > 0 {
+					x /= agg.minutes
+				} else {
+					x = agg.sums[f] / float64(agg.count)
+				}
+			}
+			set.Values[f] = x
+		}
+		sets[i] = set
+	}
+	return sets
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAggregation(t *testing.T) {
+	cases := []struct {
+		field string
+		want  string
+	}{
+		{field: "TotalCost", want: AggregationSum},
+		{field: "CPUEfficiency", want: AggregationAvg},
+		{field: "TotalEfficiency", want: AggregationAvg},
+		{field: "Minutes", want: AggregationMax},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, DefaultAggregation(c.field), c.field)
+	}
+}
+
+func TestGetAggregations(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+    - name: cpu_efficiency
+      field: CPUEfficiency
+    - name: cpu_cores
+      field: CPUCores
+      aggregation: MAX
+    - name: ram_bytes
+      field: RAMBytes
+      aggregation: median
+`))
+	assert.Equal(t, map[string]string{
+		"TotalCost":     AggregationSum,
+		"CPUEfficiency": AggregationAvg,
+		"CPUCores":      AggregationMax,
+		"RAMBytes":      AggregationSum,
+	}, GetAggregations(v))
+}
+
+func TestAggregator(t *testing.T) {
+	g := NewAggregator(map[string]string{"CPUCores": AggregationMax}, []string{"TotalCost", "CPUEfficiency", "CPUCores"})
+	a, b := prometheus.Labels{"namespace": "a"}, prometheus.Labels{"namespace": "b"}
+	assert.False(t, g.Add(a, Allocation{Minutes: 30, TotalCost: 1, CPUEfficiency: 0.2, CPUCores: 2}))
+	assert.False(t, g.Add(b, Allocation{TotalCost: 5, CPUEfficiency: 0.4}))
+	assert.True(t, g.Add(a, Allocation{Minutes: 10, TotalCost: 2, CPUEfficiency: 0.6, CPUCores: 1}))
+	assert.True(t, g.Add(b, Allocation{TotalCost: 5, CPUEfficiency: 0.8}))
+	assert.Equal(t, 2, g.Collisions)
+	sets := g.Sets()
+	assert.Len(t, sets, 2)
+	assert.Equal(t, a, sets[0].Labels)
+	assert.Equal(t, 3.0, sets[0].Values["TotalCost"])
+	assert.InDelta(t, 0.3, sets[0].Values["CPUEfficiency"], 1e-9)
+	assert.Equal(t, 2.0, sets[0].Values["CPUCores"])
+	// Efficiencies are averaged without weights if minutes are 0.
+	assert.Equal(t, 10.0, sets[1].Values["TotalCost"])
+	assert.InDelta(t, 0.6, sets[1].Values["CPUEfficiency"], 1e-9)
+}
+
+func TestAllocationMetricsRecordCollisions(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+    - name: total_efficiency
+      field: TotalEfficiency
+  labels:
+    - name: namespace
+      key: "namespace"
+`))
+	m := NewAllocationMetrics(v)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"namespace": "a", "pod": "x"}, Minutes: 60, TotalCost: 1, TotalEfficiency: 0.5},
+		{Properties: map[string]any{"namespace": "a", "pod": "y"}, Minutes: 20, TotalCost: 2, TotalEfficiency: 0.1},
+	}))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("a")))
+	assert.InDelta(t, 0.4, testutil.ToFloat64(m.Metrics["TotalEfficiency"].WithLabelValues("a")), 1e-9)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Collisions))
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Kubernetes label and annotation expansion.
+//
+// Rather than listing each Kubernetes label individually in "metrics.labels"
+// (ex. labels.app), any Kubernetes label or annotation whose key matches a
+// pattern in an allowlist becomes its own Prometheus label (ex. label_app).
+// This is similar to the --metric-labels-allowlist flag of kube-state-metrics.
+//
+// For documentation on kube-state-metrics, see the following:
+//   - https://github.com/kubernetes/kube-state-metrics
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Kubernetes label and annotation sources. Each source is a key in the
+// Allocation API response properties, and its Prometheus label name prefix.
+var LabelAllowlistSources = []struct {
+	Name   string
+	Key    string
+	Prefix string
+}{
+	{Name: "labels", Key: "labels", Prefix: "label_"},
+	{Name: "annotations", Key: "annotations", Prefix: "annotation_"},
+	{Name: "namespace_labels", Key: "namespaceLabels", Prefix: "namespace_label_"},
+	{Name: "namespace_annotations", Key: "namespaceAnnotations", Prefix: "namespace_annotation_"},
+}
+
+// A LabelAllowlist holds the patterns of allowed keys for a source.
+type LabelAllowlist struct {
+	Key      string
+	Prefix   string
+	Patterns []*regexp.Regexp
+}
+
+// Get label allowlists from configuration.
+//
+// Patterns are regular expressions, anchored on both ends. If
+// "metrics.info.enabled" is true, sources without patterns default to ".*",
+// since labels are exported by the info metric only.
+func GetLabelAllowlists(v *viper.Viper) ([]LabelAllowlist, error) {
+	lists := []LabelAllowlist{}
+	for _, src := range LabelAllowlistSources {
+		patterns := cast.ToStringSlice(v.Get("metrics.label_allowlist." + src.Name))
+		if len(patterns) == 0 && v.GetBool("metrics.info.enabled") {
+			patterns = []string{".*"}
+		}
+		if len(patterns) == 0 {
+			continue
+		}
+		l := LabelAllowlist{Key: src.Key, Prefix: src.Prefix}
+		for _, p := range patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern in 'metrics.label_allowlist.%s': %w", src.Name, err)
+			}
+			l.Patterns = append(l.Patterns, re)
+		}
+		lists = append(lists, l)
+	}
+	return lists, nil
+}
+
+// Compiled label allowlists by configuration.
+var labelAllowlistsCache sync.Map
+
+// Get label allowlists from configuration, compiling them on first use.
+//
+// Invalid label allowlists are logged and ignored. They should be validated
+// at startup using GetLabelAllowlists.
+func getCachedLabelAllowlists(v *viper.Viper) []LabelAllowlist {
+	if lists, ok := labelAllowlistsCache.Load(v); ok {
+		return lists.([]LabelAllowlist)
+	}
+	lists, err := GetLabelAllowlists(v)
+	if err != nil {
+		logger.Printf("%s. Ignoring label allowlist\n", err)
+	}
+	labelAllowlistsCache.Store(v, lists)
+	return lists
+}
+
+// Replace characters that are not valid in a Prometheus label name with "_".
+var invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Sanitize a Kubernetes label or annotation key for use in a Prometheus label
+// name (ex. app.kubernetes.io/name -> app_kubernetes_io_name).
+func SanitizeLabelName(s string) string {
+	return invalidLabelNameChars.ReplaceAllString(s, "_")
+}
+
+// Create prometheus.Labels from the Kubernetes labels and annotations whose
+// keys match an allowlist.
+//
+// If several keys map to the same label name after sanitization, the value of
+// the first key in lexicographic order is used.
+func ExpandKubernetesLabels(m map[string]any, lists []LabelAllowlist) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for _, l := range lists {
+		kvs, _ := m[l.Key].(map[string]any)
+		ks := make([]string, 0, len(kvs))
+		for k := range kvs {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+		for _, k := range ks {
+			v, ok := kvs[k].(string)
+			if !ok || !matchesAny(k, l.Patterns) {
+				continue
+			}
+			name := l.Prefix + SanitizeLabelName(k)
+			if _, ok := labels[name]; !ok {
+				labels[name] = v
+			}
+		}
+	}
+	return labels
+}
+
+// Whether s matches any of the patterns.
+func matchesAny(s string, patterns []*regexp.Regexp) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
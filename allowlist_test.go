@@ -0,0 +1,92 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLabelAllowlists(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  label_allowlist:
+    labels: ["app", 'app\.kubernetes\.io/.*']
+    annotations: []
+`))
+	lists, err := GetLabelAllowlists(v)
+	assert.NoError(t, err)
+	assert.Len(t, lists, 1)
+	assert.Equal(t, "labels", lists[0].Key)
+	assert.Equal(t, "label_", lists[0].Prefix)
+	assert.Len(t, lists[0].Patterns, 2)
+	_, err = GetLabelAllowlists(NewTestConfig([]byte(`metrics:
+  label_allowlist:
+    annotations: ["("]
+`)))
+	assert.ErrorContains(t, err, "Invalid pattern in 'metrics.label_allowlist.annotations'")
+	// All keys are allowed by default when the info metric is enabled.
+	lists, err = GetLabelAllowlists(NewTestConfig([]byte(`metrics:
+  label_allowlist:
+    labels: ["app"]
+  info:
+    enabled: true
+`)))
+	assert.NoError(t, err)
+	assert.Len(t, lists, len(LabelAllowlistSources))
+	assert.Equal(t, "^(?:app)$", lists[0].Patterns[0].String())
+	assert.Equal(t, "^(?:.*)$", lists[1].Patterns[0].String())
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{s: "app", want: "app"},
+		{s: "app.kubernetes.io/name", want: "app_kubernetes_io_name"},
+		{s: "team-name", want: "team_name"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.s, func(t *testing.T) {
+			assert.Equal(t, tc.want, SanitizeLabelName(tc.s))
+		})
+	}
+}
+
+func TestExpandKubernetesLabels(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  label_allowlist:
+    labels: ["app", 'app\.kubernetes\.io/.*']
+    annotations: [".*"]
+    namespace_labels: ["team"]
+`))
+	lists, err := GetLabelAllowlists(v)
+	assert.NoError(t, err)
+	m := map[string]any{
+		"labels": map[string]any{
+			"app":                       "api",
+			"app.kubernetes.io/name":    "api",
+			"app.kubernetes.io/version": "v1",
+			"pod-template-hash":         "abc123",
+		},
+		"annotations": map[string]any{
+			"owner":   "team-a",
+			"owner.x": "b",
+			"owner_x": "c",
+		},
+		"namespaceLabels": map[string]any{"team": "a"},
+	}
+	assert.Equal(t, prometheus.Labels{
+		"label_app":                       "api",
+		"label_app_kubernetes_io_name":    "api",
+		"label_app_kubernetes_io_version": "v1",
+		"annotation_owner":                "team-a",
+		// "owner.x" and "owner_x" collide. "owner.x" is first.
+		"annotation_owner_x":   "b",
+		"namespace_label_team": "a",
+	}, ExpandKubernetesLabels(m, lists))
+}
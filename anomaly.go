@@ -0,0 +1,168 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Cost anomaly detection.
+//
+// A rolling baseline (mean and standard deviation over the previous N cycles)
+// is maintained for each series, that is, each label set. The anomaly score of
+// a series is the number of standard deviations its current value is from the
+// baseline mean (z-score):
+//
+//	score = (value - mean) / max(deviation, min_deviation)
+//
+// A series is flagged as anomalous when the absolute value of its score
+// exceeds the configured threshold.
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// The baseline of a series.
+type anomalyBaseline struct {
+	labels prometheus.Labels
+	values []float64
+	// Number of consecutive cycles the series has been absent for.
+	absent int
+}
+
+// Mean and population standard deviation of the values.
+func (b *anomalyBaseline) stats() (float64, float64) {
+	var sum, sq float64
+	for _, x := range b.values {
+		sum += x
+	}
+	mean := sum / float64(len(b.values))
+	for _, x := range b.values {
+		sq += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(b.values)))
+}
+
+// AnomalyMetrics holds the anomaly score and flag metrics for each series. It
+// implements both the Recorder and prometheus.Collector interfaces.
+type AnomalyMetrics struct {
+	config       *viper.Viper
+	field        string
+	cycles       int
+	minCycles    int
+	threshold    float64
+	minDeviation float64
+	baselines    map[string]*anomalyBaseline
+	Score        *prometheus.GaugeVec
+	Anomaly      *prometheus.GaugeVec
+}
+
+// Create new AnomalyMetrics from configuration.
+func NewAnomalyMetrics(v *viper.Viper) *AnomalyMetrics {
+	labels := GetPrometheusMetricsLabelNames(v)
+	field := v.GetString("anomaly.field")
+	if field == "" {
+		field = "TotalCost"
+	}
+	cycles := v.GetInt("anomaly.cycles")
+	if cycles < 2 {
+		logger.Printf("Invalid 'anomaly.cycles' config: %d. Defaulting to 60", cycles)
+		cycles = 60
+	}
+	minCycles := v.GetInt("anomaly.min_cycles")
+	if minCycles < 2 || minCycles > cycles {
+		logger.Printf("Invalid 'anomaly.min_cycles' config: %d. Defaulting to %d", minCycles, cycles)
+		minCycles = cycles
+	}
+	// A positive lower bound of the deviation keeps scores finite.
+	minDeviation := v.GetFloat64("anomaly.min_deviation")
+	if minDeviation <= 0 {
+		logger.Printf("Invalid 'anomaly.min_deviation' config: %g. Defaulting to 0.01", minDeviation)
+		minDeviation = 0.01
+	}
+	return &AnomalyMetrics{
+		config:       v,
+		field:        field,
+		cycles:       cycles,
+		minCycles:    minCycles,
+		threshold:    v.GetFloat64("anomaly.threshold"),
+		minDeviation: minDeviation,
+		baselines:    map[string]*anomalyBaseline{},
+		Score: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: v.GetString("metrics.namespace"),
+				Subsystem: v.GetString("metrics.subsystem"),
+				Name:      "anomaly_score",
+				Help:      "Number of standard deviations of " + field + " from its rolling baseline mean.",
+			}, labels,
+		),
+		Anomaly: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: v.GetString("metrics.namespace"),
+				Subsystem: v.GetString("metrics.subsystem"),
+				Name:      "anomaly",
+				Help:      "Whether " + field + " is anomalous (1) or not (0).",
+			}, labels,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *AnomalyMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.Score.Describe(ch)
+	m.Anomaly.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *AnomalyMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.Score.Collect(ch)
+	m.Anomaly.Collect(ch)
+}
+
+// Score the current value of each series against its baseline, then add the
+// value to the baseline.
+//
+// Series are scored once their baseline comprises at least
+// "anomaly.min_cycles" values. The metrics of absent series are deleted
+// immediately, while their baselines are kept until they are absent for
+// "anomaly.cycles" consecutive cycles.
+func (m *AnomalyMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	series := SumByLabels(m.config, as, []string{m.field})
+	for k, b := range m.baselines {
+		if _, ok := series[k]; ok {
+			continue
+		}
+		if b.absent == 0 {
+			m.Score.Delete(b.labels)
+			m.Anomaly.Delete(b.labels)
+		}
+		b.absent++
+		if b.absent >= m.cycles {
+			delete(m.baselines, k)
+		}
+	}
+	for k, s := range series {
+		b, ok := m.baselines[k]
+		if !ok {
+			b = &anomalyBaseline{labels: s.Labels}
+			m.baselines[k] = b
+		}
+		b.absent = 0
+		x := s.Values[m.field]
+		if len(b.values) >= m.minCycles {
+			mean, dev := b.stats()
+			score := (x - mean) / math.Max(dev, m.minDeviation)
+			var anomaly float64
+			if math.Abs(score) > m.threshold {
+				anomaly = 1
+			}
+			m.Score.With(s.Labels).Set(score)
+			m.Anomaly.With(s.Labels).Set(anomaly)
+		}
+		b.values = append(b.values, x)
+		if len(b.values) > m.cycles {
+			b.values = b.values[len(b.values)-m.cycles:]
+		}
+	}
+	return nil
+}
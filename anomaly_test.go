@@ -0,0 +1,87 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnomalyMetricsRecord(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  labels:
+    - name: namespace
+      key: namespace
+anomaly:
+  field: TotalCost
+  cycles: 4
+  min_cycles: 2
+  threshold: 3
+  min_deviation: 0.01
+`))
+	m := NewAnomalyMetrics(v)
+	record := func(costs map[string]float64) {
+		as := []Allocation{}
+		for ns, cost := range costs {
+			as = append(as, Allocation{Properties: map[string]any{"namespace": ns}, TotalCost: cost})
+		}
+		assert.NoError(t, m.Record(nil, as))
+	}
+	// Baseline of "a" is [1, 3], that is, a mean of 2 and deviation of 1.
+	record(map[string]float64{"a": 1, "b": 1})
+	record(map[string]float64{"a": 3, "b": 1})
+	assert.Equal(t, 0, testutil.CollectAndCount(m.Score))
+	record(map[string]float64{"a": 4, "b": 1})
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Score.WithLabelValues("a")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.Anomaly.WithLabelValues("a")))
+	// The deviation of "b" is 0, so min_deviation is used.
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.Score.WithLabelValues("b")))
+	record(map[string]float64{"a": 100, "b": 1.5})
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Anomaly.WithLabelValues("a")))
+	assert.InDelta(t, 50.0, testutil.ToFloat64(m.Score.WithLabelValues("b")), 1e-9)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Anomaly.WithLabelValues("b")))
+	// Baselines are limited to the last 4 cycles.
+	assert.Len(t, m.baselines[GetLabelsKey(map[string]string{"namespace": "a"})].values, 4)
+	// The metrics of "b" are deleted once absent, while its baseline is kept
+	// until absent for 4 consecutive cycles.
+	record(map[string]float64{"a": 100})
+	assert.Equal(t, 1, testutil.CollectAndCount(m.Score))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.Anomaly))
+	assert.Len(t, m.baselines, 2)
+	for i := 0; i < 3; i++ {
+		record(map[string]float64{"a": 100})
+	}
+	assert.Len(t, m.baselines, 1)
+	assert.Equal(t, 1, testutil.CollectAndCount(m.Score))
+}
+
+func TestAnomalyBaselineStats(t *testing.T) {
+	b := anomalyBaseline{values: []float64{2, 4, 4, 4, 5, 5, 7, 9}}
+	mean, dev := b.stats()
+	assert.Equal(t, 5.0, mean)
+	assert.Equal(t, 2.0, dev)
+}
+
+func TestNewAnomalyMetricsDefaults(t *testing.T) {
+	DisableLogger()
+	m := NewAnomalyMetrics(NewTestConfig([]byte(`metrics:
+  labels: []
+anomaly:
+  cycles: 4
+  min_cycles: 1
+  min_deviation: 0
+`)))
+	assert.Equal(t, 4, m.minCycles)
+	assert.Equal(t, 0.01, m.minDeviation)
+	// Scores of constant baselines are finite.
+	for _, cost := range []float64{0, 0, 0, 0, 1} {
+		assert.NoError(t, m.Record(nil, []Allocation{{TotalCost: cost}}))
+	}
+	assert.Equal(t, 100.0, testutil.ToFloat64(m.Score.WithLabelValues()))
+}
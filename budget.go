@@ -0,0 +1,184 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Budget tracking.
+//
+// Budgets are declared in configuration. For each budget, the budget amount,
+// the spend-to-date for the current period and the utilization ratio
+// (spend-to-date / amount) are exported as metrics, so that alerts can be
+// defined in Prometheus without maintaining budget amounts in recording rules.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Budget periods.
+const (
+	BudgetPeriodMonthly = "monthly"
+	BudgetPeriodWeekly  = "weekly"
+)
+
+// A Budget for the allocations matching a key and value.
+type Budget struct {
+	Name   string
+	Amount float64
+	Period string
+	// Dot-separated key in the Allocation API response properties (ex.
+	// "namespace", "labels.team"). If empty, the allocation name (that is, the
+	// value of the aggregation key) is matched against Value.
+	Key   string
+	Value string
+}
+
+// Whether the allocation counts towards the budget.
+func (b Budget) Matches(a Allocation) bool {
+	if b.Key == "" {
+		return a.Name == b.Value
+	}
+	elem, ok := GetElementFromKey(b.Key, a.Properties).(string)
+	return ok && elem == b.Value
+}
+
+// Get budgets from configuration.
+//
+// Budgets with an unknown period are skipped.
+func GetBudgets(v *viper.Viper) []Budget {
+	items, _ := v.Get("budgets.items").([]any)
+	budgets := []Budget{}
+	for _, item := range items {
+		m := item.(map[string]any)
+		b := Budget{
+			Name:   GetElementOrZeroValue[string]("name", m),
+			Amount: cast.ToFloat64(m["amount"]),
+			Period: GetElementOrZeroValue[string]("period", m),
+			Key:    GetElementOrZeroValue[string]("key", m),
+			Value:  GetElementOrZeroValue[string]("value", m),
+		}
+		if b.Period == "" {
+			b.Period = BudgetPeriodMonthly
+		}
+		if b.Period != BudgetPeriodMonthly && b.Period != BudgetPeriodWeekly {
+			logger.Printf("Unknown period '%s' for budget '%s'. Skipping\n", b.Period, b.Name)
+			continue
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets
+}
+
+// Get the start of the budget period containing the given time.
+//
+// Monthly periods start on the first day of the month. Weekly periods start on
+// Monday.
+func GetBudgetPeriodStart(now time.Time, period string) time.Time {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case BudgetPeriodWeekly:
+		// time.Weekday starts on Sunday (0).
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	default:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+}
+
+// BudgetMetrics holds the budget amount, spend-to-date and utilization
+// metrics for each configured budget. It implements both the Recorder and
+// prometheus.Collector interfaces.
+type BudgetMetrics struct {
+	config      *viper.Viper
+	interval    time.Duration
+	last        time.Time
+	budgets     []Budget
+	Amount      *prometheus.GaugeVec
+	Spend       *prometheus.GaugeVec
+	Utilization *prometheus.GaugeVec
+}
+
+// Create new BudgetMetrics from configuration.
+func NewBudgetMetrics(v *viper.Viper) *BudgetMetrics {
+	interval, err := ParseDuration(v.GetString("budgets.update_interval"))
+	if err != nil {
+		logger.Printf("Error parsing 'budgets.update_interval' config: %v. Defaulting to 1h", err)
+		interval = time.Hour
+	}
+	labels := []string{"budget", "period"}
+	newGaugeVec := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: v.GetString("metrics.namespace"),
+				Subsystem: v.GetString("metrics.subsystem"),
+				Name:      name,
+				Help:      help,
+			}, labels,
+		)
+	}
+	return &BudgetMetrics{
+		config:      v,
+		interval:    interval,
+		budgets:     GetBudgets(v),
+		Amount:      newGaugeVec("budget_amount", "Budget amount for the period."),
+		Spend:       newGaugeVec("budget_spend", "Total cost of matching allocations for the period to date."),
+		Utilization: newGaugeVec("budget_utilization_ratio", "Ratio of spend-to-date to budget amount."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (b *BudgetMetrics) Describe(ch chan<- *prometheus.Desc) {
+	b.Amount.Describe(ch)
+	b.Spend.Describe(ch)
+	b.Utilization.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (b *BudgetMetrics) Collect(ch chan<- prometheus.Metric) {
+	b.Amount.Collect(ch)
+	b.Spend.Collect(ch)
+	b.Utilization.Collect(ch)
+}
+
+// Retrieve period-to-date cost allocation data and update metrics.
+//
+// The Allocation API is queried once per distinct period, at most once per
+// "budgets.update_interval".
+func (b *BudgetMetrics) Record(c AllocationAPI, _ []Allocation) error {
+	now := Now()
+	if !b.last.IsZero() && now.Sub(b.last) < b.interval {
+		return nil
+	}
+	end := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location())
+	periods := map[string][]Allocation{}
+	for _, budget := range b.budgets {
+		if _, ok := periods[budget.Period]; ok {
+			continue
+		}
+		as, err := GetAllocationForWindow(c, b.config, QueryBudgets, GetBudgetPeriodStart(end, budget.Period), end)
+		if err != nil {
+			return fmt.Errorf("Failed to retrieve %s budget spend: %w", budget.Period, err)
+		}
+		periods[budget.Period] = as
+	}
+	for _, budget := range b.budgets {
+		var spend float64
+		for _, a := range periods[budget.Period] {
+			if budget.Matches(a) {
+				spend += a.TotalCost
+			}
+		}
+		ls := prometheus.Labels{"budget": budget.Name, "period": budget.Period}
+		b.Amount.With(ls).Set(budget.Amount)
+		b.Spend.With(ls).Set(spend)
+		if budget.Amount > 0 {
+			b.Utilization.With(ls).Set(spend / budget.Amount)
+		}
+	}
+	b.last = now
+	return nil
+}
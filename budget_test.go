@@ -0,0 +1,135 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBudgets(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`budgets:
+  items:
+    - name: a
+      amount: 100
+      key: namespace
+      value: a
+    - name: b
+      amount: 12.5
+      period: weekly
+      value: b
+    - name: c
+      amount: 1
+      period: daily
+`))
+	assert.Equal(t, []Budget{
+		{Name: "a", Amount: 100, Period: BudgetPeriodMonthly, Key: "namespace", Value: "a"},
+		{Name: "b", Amount: 12.5, Period: BudgetPeriodWeekly, Value: "b"},
+	}, GetBudgets(v))
+}
+
+func TestBudgetMatches(t *testing.T) {
+	a := Allocation{
+		Name: "my-pod",
+		Properties: map[string]any{
+			"namespace": "a",
+			"labels":    map[string]any{"team": "x"},
+		},
+	}
+	cases := []struct {
+		b    Budget
+		want bool
+	}{
+		{b: Budget{Key: "namespace", Value: "a"}, want: true},
+		{b: Budget{Key: "namespace", Value: "b"}, want: false},
+		{b: Budget{Key: "labels.team", Value: "x"}, want: true},
+		{b: Budget{Key: "labels.missing", Value: ""}, want: false},
+		{b: Budget{Value: "my-pod"}, want: true},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.b.Matches(a))
+		})
+	}
+}
+
+func TestGetBudgetPeriodStart(t *testing.T) {
+	cases := []struct {
+		now    string
+		period string
+		want   string
+	}{
+		{now: "1970-01-15T12:30:00Z", period: BudgetPeriodMonthly, want: "1970-01-01T00:00:00Z"},
+		// 1970-01-01 was a Thursday.
+		{now: "1970-01-01T12:30:00Z", period: BudgetPeriodWeekly, want: "1969-12-29T00:00:00Z"},
+		{now: "1970-01-05T00:00:00Z", period: BudgetPeriodWeekly, want: "1970-01-05T00:00:00Z"},
+		{now: "1970-01-11T23:59:00Z", period: BudgetPeriodWeekly, want: "1970-01-05T00:00:00Z"},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			now, _ := time.Parse(time.RFC3339, tc.now)
+			assert.Equal(t, tc.want, GetBudgetPeriodStart(now, tc.period).Format(time.RFC3339))
+		})
+	}
+}
+
+func TestBudgetMetricsRecord(t *testing.T) {
+	Now = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "1970-01-02T00:00:00Z")
+		return t
+	}
+	defer func() { Now = time.Now }()
+	v := NewTestConfig([]byte(`api:
+  host: localhost
+  port: 9003
+  path: /allocation/compute
+  parameters:
+    window: 1m
+    aggregate: pod
+metrics:
+  namespace: kubecost
+budgets:
+  items:
+    - name: a
+      amount: 100
+      key: namespace
+      value: a
+    - name: b
+      amount: 10
+      period: weekly
+      key: namespace
+      value: b
+`))
+	ctrl := gomock.NewController(t)
+	c := NewMockAllocationAPI(ctrl)
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1970-01-01T00:00:00Z,1970-01-02T00:00:00Z",
+		"aggregate": "pod",
+	}).Return("monthly")
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1969-12-29T00:00:00Z,1970-01-02T00:00:00Z",
+		"aggregate": "pod",
+	}).Return("weekly")
+	c.EXPECT().GetAllocation("monthly").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 20},
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 5},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 1},
+	}, nil)
+	c.EXPECT().GetAllocation("weekly").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 15},
+	}, nil)
+	b := NewBudgetMetrics(v)
+	assert.NoError(t, b.Record(c, nil))
+	assert.Equal(t, 100.0, testutil.ToFloat64(b.Amount.WithLabelValues("a", "monthly")))
+	assert.Equal(t, 25.0, testutil.ToFloat64(b.Spend.WithLabelValues("a", "monthly")))
+	assert.Equal(t, 0.25, testutil.ToFloat64(b.Utilization.WithLabelValues("a", "monthly")))
+	assert.Equal(t, 15.0, testutil.ToFloat64(b.Spend.WithLabelValues("b", "weekly")))
+	assert.Equal(t, 1.5, testutil.ToFloat64(b.Utilization.WithLabelValues("b", "weekly")))
+}
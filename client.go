@@ -13,6 +13,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,6 +21,7 @@ import (
 	"net/http"
 	urlpkg "net/url"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -40,6 +42,7 @@ type AllocationAPI interface {
 // See: net/http/client.go
 type HTTPClient interface {
 	Get(url string) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
 // AllocationAPIClient is an application-specific HTTP client. It implements
@@ -130,6 +133,11 @@ func (a Allocation) GetValueByFieldNameFloat(name string) float64 {
 	return fv.Float()
 }
 
+// Keywords accepted by the 'window' parameter of the Kubecost Allocation API.
+// They are resolved by Kubecost (ex. yesterday is the previous day, midnight to
+// midnight, in the timezone of Kubecost).
+var KubecostWindowKeywords = []string{"today", "yesterday", "week", "month", "lastweek", "lastmonth"}
+
 // Generate Kubecost Allocation API URL.
 func (c AllocationAPIClient) GetURL(host string, port int, path string, params map[string]any) string {
 	url := urlpkg.URL{
@@ -141,6 +149,14 @@ func (c AllocationAPIClient) GetURL(host string, port int, path string, params m
 	for k, v := range params {
 		query.Add(k, v.(string))
 	}
+	// A window that is already a comma-separated RFC3339 date pair, or a
+	// keyword of the Kubecost Allocation API (ex. yesterday), is added to the
+	// query as-is.
+	window := params["window"].(string)
+	if strings.Contains(window, ",") || contains(KubecostWindowKeywords, window) {
+		url.RawQuery = query.Encode()
+		return url.String()
+	}
 	// Durations (such as 30m, 12h, 7d) are calculated as a precise start and end
 	// time and added to the query as a comma-separated RFC3339 date pair for the
 	// previous minute:
@@ -157,18 +173,40 @@ func (c AllocationAPIClient) GetURL(host string, port int, path string, params m
 	// This ensures that the window is the exact specified duration, since the
 	// Kubecost Allocation API uses an end time of when the request was made when
 	// the 'window' parameter contains a duration.
-	dur, err := time.ParseDuration(params["window"].(string))
+	start, end := GetWindow(window, 0)
+	query.Set("window", FormatWindow(start, end))
+	url.RawQuery = query.Encode()
+	return url.String()
+}
+
+// Get the start and end time of a window given as a duration (ex. 30m, 12h,
+// 7d), ending at the start of the current minute shifted back by offset.
+//
+// The offset is used to construct a comparison window (ex. the same window
+// one week earlier):
+//
+//	Example:
+//
+//	  Given the current time of 2006-01-09T15:04:05Z07:00, a window of 1d and
+//	  an offset of 7d would yield the following date pair:
+//
+//	    * 2006-01-01T15:04:00,2006-01-02T15:04:00
+func GetWindow(window string, offset time.Duration) (time.Time, time.Time) {
+	dur, err := ParseDuration(window)
 	if err != nil {
 		logger.Printf("Error parsing 'window' config: %v. Defaulting to 1m", err)
-		dur, _ = time.ParseDuration("1m")
+		dur = time.Minute
 	}
 	now := Now()
 	end := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location())
-	start := end.Add(-dur)
-	window := fmt.Sprintf("%s,%s", start.Format(time.RFC3339), end.Format(time.RFC3339))
-	query.Set("window", window)
-	url.RawQuery = query.Encode()
-	return url.String()
+	end = end.Add(-offset)
+	return end.Add(-dur), end
+}
+
+// Format a window as a comma-separated RFC3339 date pair, as accepted by the
+// 'window' parameter of the Kubecost Allocation API.
+func FormatWindow(start, end time.Time) string {
+	return fmt.Sprintf("%s,%s", start.Format(time.RFC3339), end.Format(time.RFC3339))
 }
 
 // Retrieve cost allocation data from the Kubecost Allocation API.
@@ -205,3 +243,24 @@ func (c AllocationAPIClient) GetAllocation(url string) ([]Allocation, error) {
 	}
 	return as, nil
 }
+
+// Retrieve the raw response of the Kubecost Allocation API: the status code
+// and the body. Responses with a status code other than 200 are not errors.
+// The request is canceled when the context is done.
+func (c AllocationAPIClient) GetRaw(ctx context.Context, url string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrFailedAllocationAPICall, err)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrFailedAllocationAPICall, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf(
+			"%w: unable to read response body: %v", ErrFailedAllocationAPICall, err)
+	}
+	return resp.StatusCode, body, nil
+}
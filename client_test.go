@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -95,6 +96,23 @@ func TestGetURL(t *testing.T) {
 				}.Encode(),
 			}).String(),
 		},
+		{
+			host:   "localhost",
+			port:   9003,
+			path:   "/allocation/compute",
+			params: map[string]any{"window": "1d", "aggregate": "pod"},
+			want: Ptr(urlpkg.URL{
+				Scheme: "http",
+				Host:   "localhost:9003",
+				Path:   "/allocation/compute",
+				RawQuery: urlpkg.Values{
+					// 'window' should be the previous full 1 day, that is:
+					//   * 1969-12-31T01:33:00+07:00 -> 1970-01-01T01:33:00+07:00
+					"window":    []string{"1969-12-31T01:33:00Z,1970-01-01T01:33:00Z"},
+					"aggregate": []string{"pod"},
+				}.Encode(),
+			}).String(),
+		},
 		{
 			host:   "localhost",
 			port:   9003,
@@ -112,6 +130,38 @@ func TestGetURL(t *testing.T) {
 				}.Encode(),
 			}).String(),
 		},
+		{
+			host:   "localhost",
+			port:   9003,
+			path:   "/allocation/compute",
+			params: map[string]any{"window": "1970-01-01T00:00:00Z,1970-01-01T01:00:00Z", "aggregate": "pod"},
+			want: Ptr(urlpkg.URL{
+				Scheme: "http",
+				Host:   "localhost:9003",
+				Path:   "/allocation/compute",
+				RawQuery: urlpkg.Values{
+					// 'window' should be passed through as-is.
+					"window":    []string{"1970-01-01T00:00:00Z,1970-01-01T01:00:00Z"},
+					"aggregate": []string{"pod"},
+				}.Encode(),
+			}).String(),
+		},
+		{
+			host:   "localhost",
+			port:   9003,
+			path:   "/allocation/compute",
+			params: map[string]any{"window": "yesterday", "aggregate": "pod"},
+			want: Ptr(urlpkg.URL{
+				Scheme: "http",
+				Host:   "localhost:9003",
+				Path:   "/allocation/compute",
+				RawQuery: urlpkg.Values{
+					// Kubecost keywords should be passed through as-is.
+					"window":    []string{"yesterday"},
+					"aggregate": []string{"pod"},
+				}.Encode(),
+			}).String(),
+		},
 	}
 	for _, tc := range cases {
 		t.Run("", func(t *testing.T) {
@@ -122,6 +172,31 @@ func TestGetURL(t *testing.T) {
 	}
 }
 
+func TestGetWindow(t *testing.T) {
+	DisableLogger()
+	Now = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "1970-01-09T15:04:05Z")
+		return t
+	}
+	defer func() { Now = time.Now }()
+	cases := []struct {
+		window string
+		offset time.Duration
+		want   string
+	}{
+		{window: "1h", offset: 0, want: "1970-01-09T14:04:00Z,1970-01-09T15:04:00Z"},
+		{window: "1d", offset: 24 * time.Hour, want: "1970-01-07T15:04:00Z,1970-01-08T15:04:00Z"},
+		{window: "1d", offset: 7 * 24 * time.Hour, want: "1970-01-01T15:04:00Z,1970-01-02T15:04:00Z"},
+		{window: "bad value", offset: time.Hour, want: "1970-01-09T14:03:00Z,1970-01-09T14:04:00Z"},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			start, end := GetWindow(tc.window, tc.offset)
+			assert.Equal(t, tc.want, FormatWindow(start, end))
+		})
+	}
+}
+
 func TestGetValueByFieldNameFloat(t *testing.T) {
 	cases := []struct {
 		name string
@@ -162,6 +237,11 @@ func (m MockHTTPClient) Get(url string) (resp *http.Response, err error) {
 	return m.MockGetFunc(url)
 }
 
+// Do calls MockGetFunc with the URL of the request.
+func (m MockHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return m.MockGetFunc(req.URL.String())
+}
+
 func TestGetAllocation(t *testing.T) {
 	// Since we are attempting to test the scenario in which the client fails to
 	// make a connection with the server, we forgo using the test server and
@@ -401,3 +481,35 @@ func TestGetAllocation(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRaw(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": 400}`))
+	}))
+	defer ts.Close()
+	c := AllocationAPIClient{
+		Client: &http.Client{},
+	}
+	// Responses with a status code other than 200 are returned as-is.
+	status, body, err := c.GetRaw(context.Background(), ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `{"code": 400}`, string(body))
+
+	c.Client = &MockHTTPClient{
+		MockGetFunc: func(url string) (resp *http.Response, err error) {
+			return nil, fmt.Errorf("connection refused")
+		},
+	}
+	_, _, err = c.GetRaw(context.Background(), ts.URL)
+	assert.ErrorIs(t, err, ErrFailedAllocationAPICall)
+
+	// Requests are canceled with the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Client = &http.Client{}
+	_, _, err = c.GetRaw(ctx, ts.URL)
+	assert.ErrorIs(t, err, ErrFailedAllocationAPICall)
+	assert.ErrorContains(t, err, context.Canceled.Error())
+}
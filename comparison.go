@@ -0,0 +1,171 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Period-over-period cost comparisons (ex. day-over-day, week-over-week).
+//
+// For each comparison, the Allocation API is queried for the current window
+// and for the same window shifted back by an offset (the comparison period).
+// The delta (current - previous) and ratio (current / previous) are exported
+// per label set.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// A Comparison of a window against the same window shifted back by offset.
+type Comparison struct {
+	// Name of the comparison (ex. week_over_week). Used as a prefix of the
+	// metric names.
+	Name   string
+	Window string
+	Offset time.Duration
+	Delta  PrometheusMetrics
+	Ratio  PrometheusMetrics
+}
+
+// ComparisonMetrics holds the delta and ratio metrics of each configured
+// comparison. It implements both the Recorder and prometheus.Collector
+// interfaces.
+type ComparisonMetrics struct {
+	config      *viper.Viper
+	interval    time.Duration
+	last        time.Time
+	fields      []string
+	Comparisons []Comparison
+}
+
+// Create new ComparisonMetrics from configuration.
+//
+// For each comparison (ex. week_over_week) and each element in
+// "comparisons.names" (ex. total_cost), the following metrics are generated:
+//
+//   - week_over_week_total_cost_delta
+//   - week_over_week_total_cost_ratio
+//
+// An error is returned if the window or offset of a comparison is not a
+// positive duration.
+func NewComparisonMetrics(v *viper.Viper) (*ComparisonMetrics, error) {
+	interval, err := ParseDuration(v.GetString("comparisons.update_interval"))
+	if err != nil {
+		logger.Printf("Error parsing 'comparisons.update_interval' config: %v. Defaulting to 1h", err)
+		interval = time.Hour
+	}
+	names := GetNameFieldMappings(v, "comparisons.names")
+	fields := make([]string, len(names))
+	for i, n := range names {
+		fields[i] = n["field"]
+	}
+	items, _ := v.Get("comparisons.items").([]any)
+	comparisons := []Comparison{}
+	for _, item := range items {
+		m := item.(map[string]any)
+		name := GetElementOrZeroValue[string]("name", m)
+		window := GetElementOrZeroValue[string]("window", m)
+		if d, err := ParseDuration(window); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Comparison '%s': 'window' must be a positive duration, got '%s'", name, window)
+		}
+		s := GetElementOrZeroValue[string]("offset", m)
+		offset, err := ParseDuration(s)
+		if err != nil || offset <= 0 {
+			return nil, fmt.Errorf("Comparison '%s': 'offset' must be a positive duration, got '%s'", name, s)
+		}
+		withSuffix := make([]map[string]string, len(names))
+		for i, n := range names {
+			withSuffix[i] = map[string]string{"name": n["name"] + "_delta", "field": n["field"]}
+		}
+		delta := NewPrometheusMetricsFromNames(v, withSuffix, name+"_")
+		for i, n := range names {
+			withSuffix[i] = map[string]string{"name": n["name"] + "_ratio", "field": n["field"]}
+		}
+		ratio := NewPrometheusMetricsFromNames(v, withSuffix, name+"_")
+		comparisons = append(comparisons, Comparison{
+			Name:   name,
+			Window: window,
+			Offset: offset,
+			Delta:  delta,
+			Ratio:  ratio,
+		})
+	}
+	return &ComparisonMetrics{
+		config:      v,
+		interval:    interval,
+		fields:      fields,
+		Comparisons: comparisons,
+	}, nil
+}
+
+// Describe implements prometheus.Collector.
+func (m *ComparisonMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.Comparisons {
+		c.Delta.Describe(ch)
+		c.Ratio.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *ComparisonMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.Comparisons {
+		c.Delta.Collect(ch)
+		c.Ratio.Collect(ch)
+	}
+}
+
+// Retrieve cost allocation data for the current and comparison windows and
+// update metrics.
+//
+// The Allocation API is queried at most once per
+// "comparisons.update_interval". Label sets absent from the comparison window
+// are compared against 0. The ratio is not exported when the comparison value
+// is 0.
+func (m *ComparisonMetrics) Record(c AllocationAPI, _ []Allocation) error {
+	now := Now()
+	if !m.last.IsZero() && now.Sub(m.last) < m.interval {
+		return nil
+	}
+	errs := []error{}
+	for _, cmp := range m.Comparisons {
+		start, end := GetWindow(cmp.Window, 0)
+		current, err := GetAllocationForWindow(c, m.config, QueryComparisons, start, end)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Comparison '%s': %w", cmp.Name, err))
+			continue
+		}
+		start, end = GetWindow(cmp.Window, cmp.Offset)
+		previous, err := GetAllocationForWindow(c, m.config, QueryComparisons, start, end)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Comparison '%s': %w", cmp.Name, err))
+			continue
+		}
+		cur, prev := SumByLabels(m.config, current, m.fields), SumByLabels(m.config, previous, m.fields)
+		// Remove label sets which are no longer present in either window.
+		for _, field := range m.fields {
+			cmp.Delta[field].Reset()
+			cmp.Ratio[field].Reset()
+		}
+		for k, p := range prev {
+			if _, ok := cur[k]; !ok {
+				cur[k] = &LabelSetValues{Labels: p.Labels, Values: map[string]float64{}}
+			}
+		}
+		for k, cv := range cur {
+			for _, field := range m.fields {
+				var pv float64
+				if p, ok := prev[k]; ok {
+					pv = p.Values[field]
+				}
+				cmp.Delta[field].With(cv.Labels).Set(cv.Values[field] - pv)
+				if pv != 0 {
+					cmp.Ratio[field].With(cv.Labels).Set(cv.Values[field] / pv)
+				}
+			}
+		}
+	}
+	m.last = now
+	return JoinErrors(errs)
+}
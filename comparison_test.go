@@ -0,0 +1,126 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewComparisonMetrics(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  labels:
+    - name: namespace
+      key: namespace
+comparisons:
+  items:
+    - name: day_over_day
+      window: 1d
+      offset: 1d
+  names:
+    - name: total_cost
+      field: TotalCost
+`))
+	m, err := NewComparisonMetrics(v)
+	assert.NoError(t, err)
+	assert.Len(t, m.Comparisons, 1)
+	assert.Equal(t, "day_over_day", m.Comparisons[0].Name)
+	assert.Equal(t, 24*time.Hour, m.Comparisons[0].Offset)
+	assert.Contains(t, m.Comparisons[0].Delta, "TotalCost")
+	assert.Contains(t, m.Comparisons[0].Ratio, "TotalCost")
+}
+
+func TestNewComparisonMetricsInvalid(t *testing.T) {
+	cases := []struct {
+		item    string
+		wantErr string
+	}{
+		{"window: 1d\n      offset: bad value", "Comparison 'c': 'offset' must be a positive duration, got 'bad value'"},
+		{"window: 1d", "Comparison 'c': 'offset' must be a positive duration, got ''"},
+		{"offset: 1d", "Comparison 'c': 'window' must be a positive duration, got ''"},
+		{"window: 1x\n      offset: 1d", "Comparison 'c': 'window' must be a positive duration, got '1x'"},
+		{"window: 0s\n      offset: 1d", "Comparison 'c': 'window' must be a positive duration, got '0s'"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.item, func(t *testing.T) {
+			_, err := NewComparisonMetrics(NewTestConfig([]byte(`metrics:
+  labels: []
+comparisons:
+  items:
+    - name: c
+      ` + tc.item + `
+  names:
+    - name: total_cost
+      field: TotalCost
+`)))
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestComparisonMetricsRecord(t *testing.T) {
+	Now = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "1970-01-09T00:00:30Z")
+		return t
+	}
+	defer func() { Now = time.Now }()
+	v := NewTestConfig([]byte(`api:
+  host: localhost
+  port: 9003
+  path: /allocation/compute
+  parameters:
+    window: 1m
+    aggregate: namespace
+metrics:
+  namespace: kubecost
+  labels:
+    - name: namespace
+      key: namespace
+comparisons:
+  items:
+    - name: week_over_week
+      window: 1d
+      offset: 7d
+  names:
+    - name: total_cost
+      field: TotalCost
+`))
+	ctrl := gomock.NewController(t)
+	c := NewMockAllocationAPI(ctrl)
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1970-01-08T00:00:00Z,1970-01-09T00:00:00Z",
+		"aggregate": "namespace",
+	}).Return("current")
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1970-01-01T00:00:00Z,1970-01-02T00:00:00Z",
+		"aggregate": "namespace",
+	}).Return("previous")
+	c.EXPECT().GetAllocation("current").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 15},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 2},
+	}, nil)
+	c.EXPECT().GetAllocation("previous").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 10},
+		{Properties: map[string]any{"namespace": "c"}, TotalCost: 4},
+	}, nil)
+	m, err := NewComparisonMetrics(v)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Record(c, nil))
+	cmp := m.Comparisons[0]
+	assert.Equal(t, 5.0, testutil.ToFloat64(cmp.Delta["TotalCost"].WithLabelValues("a")))
+	assert.Equal(t, 1.5, testutil.ToFloat64(cmp.Ratio["TotalCost"].WithLabelValues("a")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(cmp.Delta["TotalCost"].WithLabelValues("b")))
+	assert.Equal(t, -4.0, testutil.ToFloat64(cmp.Delta["TotalCost"].WithLabelValues("c")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(cmp.Ratio["TotalCost"].WithLabelValues("c")))
+	// No ratio is exported for "b", since its comparison value is 0.
+	assert.Equal(t, 3, testutil.CollectAndCount(cmp.Delta["TotalCost"]))
+	assert.Equal(t, 2, testutil.CollectAndCount(cmp.Ratio["TotalCost"]))
+}
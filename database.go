@@ -0,0 +1,270 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// SQL database sink.
+//
+// After each cycle, the allocations are upserted into a table of a SQLite or
+// PostgreSQL database, keyed by window and allocation name, so that the
+// allocation history can be queried with SQL independently of the retention
+// of Kubecost. The table, its columns and its unique index are created on
+// first use, and columns are added when the configured labels change.
+//
+// The table comprises the following columns:
+//
+//   - window_start, window_end: the window of the allocation (RFC 3339)
+//   - the string and numeric fields of the Allocation struct, named after their
+//     JSON names in snake case (ex. name, minutes, cpu_cores, total_cost)
+//   - the label names (see GetPrometheusMetricsLabelNames), as text. Labels
+//     with the name of another column are omitted.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	// Register the "postgres" and "sqlite" database/sql drivers.
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// ErrFailedDatabaseWrite is returned when allocations cannot be written to the
+// database.
+var ErrFailedDatabaseWrite = errors.New("Failed to write allocations to database")
+
+// Database drivers.
+const (
+	DatabaseDriverSQLite   = "sqlite"
+	DatabaseDriverPostgres = "postgres"
+)
+
+// Valid (unquoted) table names.
+var databaseTableRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Columns of the unique key. Upserts replace the allocation of the same window
+// and name.
+var DatabaseKeyColumns = []string{"window_start", "window_end", "name"}
+
+// DatabaseWriter upserts allocations into a SQL database. It implements the
+// Recorder interface.
+type DatabaseWriter struct {
+	config  *viper.Viper
+	db      *sql.DB
+	driver  string
+	table   string
+	timeout time.Duration
+	// Whether the table has been migrated to the current columns.
+	migrated bool
+}
+
+// Create a new DatabaseWriter from configuration. The connection to the
+// database is established on first use.
+func NewDatabaseWriter(v *viper.Viper) (*DatabaseWriter, error) {
+	w := &DatabaseWriter{
+		config: v,
+		driver: v.GetString("database.driver"),
+		table:  v.GetString("database.table"),
+	}
+	switch w.driver {
+	case DatabaseDriverSQLite, DatabaseDriverPostgres:
+	default:
+		return nil, fmt.Errorf("Unknown 'database.driver' '%s'", w.driver)
+	}
+	if w.table == "" {
+		w.table = "allocations"
+	}
+	if !databaseTableRegex.MatchString(w.table) {
+		return nil, fmt.Errorf("Invalid 'database.table' '%s'", w.table)
+	}
+	timeout, err := ParseDuration(v.GetString("database.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'database.timeout' config: %v. Defaulting to 60s", err)
+		timeout = 60 * time.Second
+	}
+	w.timeout = timeout
+	dsn := v.GetString("database.dsn")
+	if dsn == "" {
+		return nil, errors.New("'database.dsn' is required")
+	}
+	if w.db, err = sql.Open(w.driver, dsn); err != nil {
+		return nil, fmt.Errorf("Error opening database: %w", err)
+	}
+	return w, nil
+}
+
+// Get the columns of the table.
+func (w *DatabaseWriter) Columns() []AllocationColumn {
+	columns := []AllocationColumn{
+		{Name: "window_start", Field: "Start"},
+		{Name: "window_end", Field: "End"},
+	}
+	seen := map[string]bool{"start": true, "end": true}
+	for _, c := range GetAllocationColumns() {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			columns = append(columns, c)
+		}
+	}
+	for _, n := range GetPrometheusMetricsLabelNames(w.config) {
+		if !seen[n] && !contains(DatabaseKeyColumns, n) {
+			seen[n] = true
+			columns = append(columns, AllocationColumn{Name: n})
+		}
+	}
+	return columns
+}
+
+// Quote an identifier. Identifiers are table names matching
+// databaseTableRegex, or column names, which are valid Prometheus label names.
+func quoteIdentifier(s string) string {
+	return `"` + s + `"`
+}
+
+// Get the SQL type of a column.
+func databaseColumnType(c AllocationColumn) string {
+	if c.Numeric {
+		return "DOUBLE PRECISION NOT NULL DEFAULT 0"
+	}
+	return "TEXT NOT NULL DEFAULT ''"
+}
+
+// Create the table and its unique index if they do not exist, and add missing
+// columns.
+func (w *DatabaseWriter) migrate(ctx context.Context, columns []AllocationColumn) error {
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		defs[i] = quoteIdentifier(c.Name) + " " + databaseColumnType(c)
+	}
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(w.table) + " (" + strings.Join(defs, ", ") + ")",
+	}
+	existing, err := w.existingColumns(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if len(existing) > 0 && !existing[c.Name] {
+			stmts = append(stmts, "ALTER TABLE "+quoteIdentifier(w.table)+" ADD COLUMN "+quoteIdentifier(c.Name)+" "+databaseColumnType(c))
+		}
+	}
+	key := make([]string, len(DatabaseKeyColumns))
+	for i, k := range DatabaseKeyColumns {
+		key[i] = quoteIdentifier(k)
+	}
+	stmts = append(stmts, "CREATE UNIQUE INDEX IF NOT EXISTS "+quoteIdentifier(w.table+"_window_name")+
+		" ON "+quoteIdentifier(w.table)+" ("+strings.Join(key, ", ")+")")
+	for _, stmt := range stmts {
+		if _, err := w.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// Get the names of the columns of the table. Returns an empty map if the table
+// does not exist.
+func (w *DatabaseWriter) existingColumns(ctx context.Context) (map[string]bool, error) {
+	columns := map[string]bool{}
+	rows, err := w.db.QueryContext(ctx, "SELECT * FROM "+quoteIdentifier(w.table)+" WHERE 1 = 0")
+	if err != nil {
+		// Assume the table does not exist. Other errors are returned when
+		// creating the table.
+		return columns, nil
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		columns[n] = true
+	}
+	return columns, nil
+}
+
+// Get the upsert statement of the columns. Both SQLite (3.24+) and PostgreSQL
+// support "INSERT ... ON CONFLICT ... DO UPDATE".
+func (w *DatabaseWriter) upsertStatement(columns []AllocationColumn) string {
+	names := make([]string, len(columns))
+	params := make([]string, len(columns))
+	updates := []string{}
+	for i, c := range columns {
+		names[i] = quoteIdentifier(c.Name)
+		params[i] = "?"
+		if w.driver == DatabaseDriverPostgres {
+			params[i] = "$" + strconv.Itoa(i+1)
+		}
+		if !contains(DatabaseKeyColumns, c.Name) {
+			updates = append(updates, names[i]+" = excluded."+names[i])
+		}
+	}
+	key := make([]string, len(DatabaseKeyColumns))
+	for i, k := range DatabaseKeyColumns {
+		key[i] = quoteIdentifier(k)
+	}
+	return "INSERT INTO " + quoteIdentifier(w.table) + " (" + strings.Join(names, ", ") + ")" +
+		" VALUES (" + strings.Join(params, ", ") + ")" +
+		" ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+// Upsert the allocations in a single transaction. Allocations dropped by
+// relabel configs are skipped. The table is migrated on first use, and after
+// failures.
+func (w *DatabaseWriter) Record(_ AllocationAPI, as []Allocation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	columns := w.Columns()
+	if !w.migrated {
+		if err := w.migrate(ctx, columns); err != nil {
+			return fmt.Errorf("%w: %v", ErrFailedDatabaseWrite, err)
+		}
+		w.migrated = true
+	}
+	if err := w.upsert(ctx, columns, as); err != nil {
+		w.migrated = false
+		return fmt.Errorf("%w: %v", ErrFailedDatabaseWrite, err)
+	}
+	return nil
+}
+
+// Upsert the allocations in a single transaction.
+func (w *DatabaseWriter) upsert(ctx context.Context, columns []AllocationColumn, as []Allocation) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, w.upsertStatement(columns))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, a := range as {
+		ls, ok := NewPrometheusLabelsFromAllocation(w.config, a)
+		if !ok {
+			continue
+		}
+		args := make([]any, len(columns))
+		av := reflect.ValueOf(a)
+		for i, c := range columns {
+			if c.Field != "" {
+				args[i] = av.FieldByName(c.Field).Interface()
+			} else {
+				args[i] = ls[c.Name]
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDatabaseWriter(t *testing.T, config string) *DatabaseWriter {
+	v := NewTestConfig([]byte(config))
+	w, err := NewDatabaseWriter(v)
+	assert.NoError(t, err)
+	t.Cleanup(func() { w.db.Close() })
+	return w
+}
+
+func TestNewDatabaseWriter(t *testing.T) {
+	cases := []string{
+		`database:
+  driver: mysql
+  dsn: x`,
+		`database:
+  driver: sqlite`,
+		`database:
+  driver: sqlite
+  dsn: x
+  table: "allocations; DROP TABLE x"`,
+	}
+	for _, c := range cases {
+		_, err := NewDatabaseWriter(NewTestConfig([]byte(c)))
+		assert.Error(t, err)
+	}
+}
+
+func TestDatabaseWriterUpsertStatement(t *testing.T) {
+	w := newTestDatabaseWriter(t, `database:
+  driver: postgres
+  dsn: postgres://localhost/kubecost`)
+	columns := []AllocationColumn{
+		{Name: "window_start"}, {Name: "window_end"}, {Name: "name"},
+		{Name: "total_cost", Numeric: true}, {Name: "namespace"},
+	}
+	assert.Equal(t, `INSERT INTO "allocations" ("window_start", "window_end", "name", "total_cost", "namespace")`+
+		` VALUES ($1, $2, $3, $4, $5)`+
+		` ON CONFLICT ("window_start", "window_end", "name") DO UPDATE SET "total_cost" = excluded."total_cost", "namespace" = excluded."namespace"`,
+		w.upsertStatement(columns))
+}
+
+func TestDatabaseWriterRecord(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "allocations.db")
+	config := `metrics:
+  labels:
+    - name: namespace
+      key: namespace
+  relabel_configs:
+    - source_labels: [namespace]
+      regex: kube-system
+      action: drop
+database:
+  driver: sqlite
+  dsn: ` + dsn + `
+  table: history`
+	w := newTestDatabaseWriter(t, config)
+	as := []Allocation{
+		{Name: "a/web", Start: "2023-11-14T00:00:00Z", End: "2023-11-15T00:00:00Z", Properties: map[string]any{"namespace": "a"}, TotalCost: 1.5},
+		{Name: "kube-system/dns", Start: "2023-11-14T00:00:00Z", End: "2023-11-15T00:00:00Z", Properties: map[string]any{"namespace": "kube-system"}, TotalCost: 2},
+		{Name: "b/api", Start: "2023-11-14T00:00:00Z", End: "2023-11-15T00:00:00Z", Properties: map[string]any{"namespace": "b"}, TotalCost: 3},
+	}
+	assert.NoError(t, w.Record(nil, as))
+	// Allocations of the same window and name are replaced.
+	as[0].TotalCost = 4
+	assert.NoError(t, w.Record(nil, as[:1]))
+	// Allocations of other windows are added.
+	as[2].Start, as[2].End = "2023-11-15T00:00:00Z", "2023-11-16T00:00:00Z"
+	assert.NoError(t, w.Record(nil, as[2:]))
+
+	type row struct {
+		start, name, namespace string
+		cost                   float64
+	}
+	query := func(w *DatabaseWriter, q string) []row {
+		rows, err := w.db.Query(q)
+		assert.NoError(t, err)
+		defer rows.Close()
+		got := []row{}
+		for rows.Next() {
+			var r row
+			assert.NoError(t, rows.Scan(&r.start, &r.name, &r.namespace, &r.cost))
+			got = append(got, r)
+		}
+		return got
+	}
+	assert.Equal(t, []row{
+		{"2023-11-14T00:00:00Z", "a/web", "a", 4},
+		{"2023-11-14T00:00:00Z", "b/api", "b", 3},
+		{"2023-11-15T00:00:00Z", "b/api", "b", 3},
+	}, query(w, `SELECT window_start, name, namespace, total_cost FROM history ORDER BY window_start, name`))
+
+	// Columns of new labels are added to the existing table.
+	w = newTestDatabaseWriter(t, strings.Replace(config, `      key: namespace
+`, `      key: namespace
+    - name: team
+      key: labels.team
+`, 1))
+	as[0].Properties = map[string]any{"namespace": "a", "labels": map[string]any{"team": "x"}}
+	assert.NoError(t, w.Record(nil, as[:1]))
+	assert.Equal(t, []row{
+		{"2023-11-14T00:00:00Z", "a/web", "x", 4},
+		{"2023-11-14T00:00:00Z", "b/api", "", 3},
+		{"2023-11-15T00:00:00Z", "b/api", "", 3},
+	}, query(w, `SELECT window_start, name, team, total_cost FROM history ORDER BY window_start, name`))
+}
@@ -0,0 +1,398 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Chargeback export to files.
+//
+// After each cycle, the allocations are written as rows to files in a
+// directory, as CSV or newline-delimited JSON (NDJSON). Each row comprises the
+// window start and end, the label values and the values of the configured
+// fields of an allocation. Rows are appended to one file per window date (ex.
+// allocations-2023-11-14.csv), optionally gzip-compressed, for pickup by batch
+// jobs.
+//
+// Since consecutive cycles usually query the same or overlapping windows, an
+// allocation is only written if its window does not overlap the window last
+// written for its name to any file, so that rows can be summed. The written
+// windows are tracked per file, so that rows are only retried for files which
+// failed to be written. If the CSV
+// columns change (ex. a label is added), existing files are rewritten with the
+// new header.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ErrFailedExport is returned when allocations cannot be written to a file.
+var ErrFailedExport = errors.New("Failed to export allocations")
+
+// Export formats.
+const (
+	ExportFormatCSV    = "csv"
+	ExportFormatNDJSON = "ndjson"
+)
+
+// Names of the window columns.
+const (
+	ExportWindowStartColumn = "window_start"
+	ExportWindowEndColumn   = "window_end"
+)
+
+// Exporter writes allocations to files. It implements the Recorder interface.
+type Exporter struct {
+	config     *viper.Viper
+	directory  string
+	format     string
+	gzip       bool
+	prefix     string
+	dateFormat string
+	maxFiles   int
+	// Window (start and end) last written by file name and allocation name.
+	exported map[string]map[string][2]string
+}
+
+// Create a new Exporter from configuration. The directory is created if it
+// does not exist.
+func NewExporter(v *viper.Viper) (*Exporter, error) {
+	e := &Exporter{
+		config:     v,
+		directory:  v.GetString("export.directory"),
+		format:     v.GetString("export.format"),
+		gzip:       v.GetBool("export.gzip"),
+		prefix:     v.GetString("export.prefix"),
+		dateFormat: v.GetString("export.date_format"),
+		maxFiles:   v.GetInt("export.max_files"),
+		exported:   map[string]map[string][2]string{},
+	}
+	if e.directory == "" {
+		return nil, errors.New("'export.directory' is required")
+	}
+	switch e.format {
+	case ExportFormatCSV, ExportFormatNDJSON:
+	case "":
+		e.format = ExportFormatCSV
+	default:
+		return nil, fmt.Errorf("Unknown 'export.format' '%s'", e.format)
+	}
+	if e.dateFormat == "" {
+		e.dateFormat = "2006-01-02"
+	}
+	if err := os.MkdirAll(e.directory, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating 'export.directory': %w", err)
+	}
+	return e, nil
+}
+
+// Get the columns of the rows: the window columns, the label names (see
+// GetPrometheusMetricsLabelNames) and the names of the metrics in
+// "metrics.names".
+func (e *Exporter) Columns() ([]string, []string) {
+	labels := GetPrometheusMetricsLabelNames(e.config)
+	columns := append([]string{ExportWindowStartColumn, ExportWindowEndColumn}, labels...)
+	fields := []string{}
+	for _, n := range GetPrometheusMetricsNames(e.config) {
+		if !contains(columns, n["name"]) {
+			columns = append(columns, n["name"])
+			fields = append(fields, n["field"])
+		}
+	}
+	return columns, fields
+}
+
+// Get the name of the file of a window start time (ex.
+// allocations-2023-11-14.csv.gz).
+func (e *Exporter) FileName(start string) string {
+	name := e.prefix + FormatWindowDate(start, e.dateFormat) + "." + e.format
+	if e.gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// Format the date of a window start time (RFC 3339) in UTC using a Go time
+// layout. Window start times which cannot be parsed default to the current
+// time.
+func FormatWindowDate(start, layout string) string {
+	t, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		t = Now()
+	}
+	return t.UTC().Format(layout)
+}
+
+// Whether the window of an allocation has not been written yet, that is,
+// whether it does not overlap the window last written for the same name to any
+// file. Windows which cannot be parsed are compared for equality.
+func (e *Exporter) unexported(a Allocation) bool {
+	for _, windows := range e.exported {
+		last, ok := windows[a.Name]
+		if !ok {
+			continue
+		}
+		start, err1 := time.Parse(time.RFC3339, a.Start)
+		end, err2 := time.Parse(time.RFC3339, a.End)
+		lastStart, err3 := time.Parse(time.RFC3339, last[0])
+		lastEnd, err4 := time.Parse(time.RFC3339, last[1])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			if last == [2]string{a.Start, a.End} {
+				return false
+			}
+			continue
+		}
+		if start.Before(lastEnd) && end.After(lastStart) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the allocations whose window has not been written yet to files,
+// grouped by window date. Allocations dropped by relabel configs are skipped.
+func (e *Exporter) Record(_ AllocationAPI, as []Allocation) error {
+	columns, fields := e.Columns()
+	labels := columns[2 : len(columns)-len(fields)]
+	rows := map[string][][]string{}
+	files := []string{}
+	// Windows written by file name and allocation name.
+	written := map[string]map[string][2]string{}
+	names := make(map[string]bool, len(as))
+	for _, a := range as {
+		names[a.Name] = true
+		ls, ok := NewPrometheusLabelsFromAllocation(e.config, a)
+		if !ok || !e.unexported(a) {
+			continue
+		}
+		row := make([]string, 0, len(columns))
+		row = append(row, a.Start, a.End)
+		for _, l := range labels {
+			row = append(row, ls[l])
+		}
+		for _, f := range fields {
+			row = append(row, strconv.FormatFloat(a.GetValueByFieldNameFloat(f), 'f', -1, 64))
+		}
+		name := e.FileName(a.Start)
+		if _, ok := rows[name]; !ok {
+			files = append(files, name)
+			written[name] = map[string][2]string{}
+		}
+		rows[name] = append(rows[name], row)
+		written[name][a.Name] = [2]string{a.Start, a.End}
+	}
+	errs := []error{}
+	for _, name := range files {
+		// If writing failed, the rows of the file are retried next cycle.
+		if err := e.write(filepath.Join(e.directory, name), columns, len(fields), rows[name]); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", ErrFailedExport, err))
+			continue
+		}
+		if e.exported[name] == nil {
+			e.exported[name] = map[string][2]string{}
+		}
+		for n, w := range written[name] {
+			e.exported[name][n] = w
+		}
+	}
+	// Windows of allocations which are no longer returned are forgotten.
+	for name, windows := range e.exported {
+		for n := range windows {
+			if !names[n] {
+				delete(windows, n)
+			}
+		}
+		if len(windows) == 0 {
+			delete(e.exported, name)
+		}
+	}
+	if err := e.prune(); err != nil {
+		errs = append(errs, fmt.Errorf("%w: %v", ErrFailedExport, err))
+	}
+	return JoinErrors(errs)
+}
+
+// Append rows to a file, whose last nfields columns are fields. The CSV header
+// is written if the file is created. Appends to gzip files are written as
+// additional gzip members, which are concatenated when decompressed.
+func (e *Exporter) write(path string, columns []string, nfields int, rows [][]string) error {
+	if e.format == ExportFormatCSV {
+		if err := e.rewriteCSV(path, columns); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if e.gzip {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	if e.format == ExportFormatCSV {
+		err = writeCSVRows(w, columns, rows, info.Size() == 0)
+	} else {
+		err = writeNDJSONRows(w, columns, rows, nfields)
+	}
+	if err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// Rewrite a CSV file whose header differs from columns. The values of existing
+// rows are mapped to the columns by name, and the values of new columns are
+// empty. Files which do not exist are ignored.
+func (e *Exporter) rewriteCSV(path string, columns []string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() == 0 {
+		return err
+	}
+	var r io.Reader = f
+	if e.gzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	if strings.Join(header, "\x00") == strings.Join(columns, "\x00") {
+		return nil
+	}
+	records, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(header))
+	for i, c := range header {
+		index[c] = i
+	}
+	rows := make([][]string, len(records))
+	for i, record := range records {
+		rows[i] = make([]string, len(columns))
+		for j, c := range columns {
+			if k, ok := index[c]; ok && k < len(record) {
+				rows[i][j] = record[k]
+			}
+		}
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if e.gzip {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	if err := writeCSVRows(w, columns, rows, true); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	f.Close()
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// Write rows as CSV, optionally preceded by a header.
+func writeCSVRows(w io.Writer, columns []string, rows [][]string, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		cw.Write(columns)
+	}
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+// Write rows as JSON objects, one per line. The values of the last n columns
+// (the fields) are numbers.
+func writeNDJSONRows(w io.Writer, columns []string, rows [][]string, n int) error {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		m := make(map[string]any, len(columns))
+		for i, c := range columns {
+			m[c] = row[i]
+			if i >= len(columns)-n {
+				m[c], _ = strconv.ParseFloat(row[i], 64)
+			}
+		}
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the oldest files if there are more than "max_files".
+func (e *Exporter) prune() error {
+	suffix := "." + e.format
+	if e.gzip {
+		suffix += ".gz"
+	}
+	return PruneFiles(e.directory, e.prefix, suffix, e.maxFiles)
+}
+
+// Remove the oldest files with the prefix and suffix in a directory, in
+// lexicographic order of name, if there are more than max. Other files are
+// ignored. A max of 0 keeps all files.
+func PruneFiles(dir, prefix, suffix string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if n := entry.Name(); !entry.IsDir() && strings.HasPrefix(n, prefix) && strings.HasSuffix(n, suffix) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for len(names) > max {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
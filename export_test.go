@@ -0,0 +1,173 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exportTestConfig = `metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+    - name: cpu_cost
+      field: CPUCost
+  labels:
+    - name: namespace
+      key: namespace
+  relabel_configs:
+    - source_labels: [namespace]
+      regex: kube-system
+      action: drop
+export:
+  directory: %s
+  format: %s
+  gzip: %t
+  max_files: %d
+`
+
+func newTestExporter(t *testing.T, format string, gz bool, maxFiles int) (*Exporter, string) {
+	dir := t.TempDir()
+	v := NewTestConfig([]byte(fmt.Sprintf(exportTestConfig, dir, format, gz, maxFiles)))
+	e, err := NewExporter(v)
+	assert.NoError(t, err)
+	return e, dir
+}
+
+var exportTestAllocations = []Allocation{
+	{Name: "a", Start: "2023-11-14T00:00:00Z", End: "2023-11-15T00:00:00Z", Properties: map[string]any{"namespace": "a"}, TotalCost: 1.5, CPUCost: 1},
+	{Name: "kube-system", Start: "2023-11-14T00:00:00Z", End: "2023-11-15T00:00:00Z", Properties: map[string]any{"namespace": "kube-system"}, TotalCost: 2},
+	{Name: "b,c", Start: "2023-11-15T00:00:00Z", End: "2023-11-16T00:00:00Z", Properties: map[string]any{"namespace": "b,c"}, TotalCost: 3},
+}
+
+func TestNewExporter(t *testing.T) {
+	_, err := NewExporter(NewTestConfig([]byte(`export:
+  format: csv`)))
+	assert.Error(t, err)
+	_, err = NewExporter(NewTestConfig([]byte(fmt.Sprintf(exportTestConfig, t.TempDir(), "xml", false, 0))))
+	assert.Error(t, err)
+}
+
+func TestExporterFileName(t *testing.T) {
+	Now = func() time.Time { return time.Date(2023, 11, 16, 0, 0, 0, 0, time.UTC) }
+	defer func() { Now = time.Now }()
+	e, _ := newTestExporter(t, ExportFormatCSV, true, 0)
+	e.prefix = "allocations-"
+	// Dates are in UTC.
+	assert.Equal(t, "allocations-2023-11-13.csv.gz", e.FileName("2023-11-14T01:00:00+02:00"))
+	assert.Equal(t, "allocations-2023-11-16.csv.gz", e.FileName(""))
+}
+
+func TestExporterRecordCSV(t *testing.T) {
+	e, dir := newTestExporter(t, ExportFormatCSV, false, 0)
+	assert.NoError(t, e.Record(nil, exportTestAllocations))
+	// Windows which have already been written, or which overlap them, are
+	// skipped.
+	assert.NoError(t, e.Record(nil, exportTestAllocations[:1]))
+	overlapping := exportTestAllocations[0]
+	overlapping.Start, overlapping.End = "2023-11-14T12:00:00Z", "2023-11-15T12:00:00Z"
+	assert.NoError(t, e.Record(nil, []Allocation{overlapping}))
+	next := exportTestAllocations[0]
+	next.Start, next.End = "2023-11-14T00:00:00Z", "2023-11-14T12:00:00Z"
+	e.exported = map[string]map[string][2]string{
+		"2023-11-13.csv": {next.Name: {"2023-11-13T12:00:00Z", "2023-11-14T00:00:00Z"}},
+	}
+	assert.NoError(t, e.Record(nil, []Allocation{next}))
+	b, err := os.ReadFile(filepath.Join(dir, "2023-11-14.csv"))
+	assert.NoError(t, err)
+	assert.Equal(t, "window_start,window_end,namespace,total_cost,cpu_cost\n"+
+		"2023-11-14T00:00:00Z,2023-11-15T00:00:00Z,a,1.5,1\n"+
+		"2023-11-14T00:00:00Z,2023-11-14T12:00:00Z,a,1.5,1\n", string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "2023-11-15.csv"))
+	assert.NoError(t, err)
+	assert.Equal(t, "window_start,window_end,namespace,total_cost,cpu_cost\n"+
+		"2023-11-15T00:00:00Z,2023-11-16T00:00:00Z,\"b,c\",3,0\n", string(b))
+}
+
+func TestExporterRecordNDJSONGzip(t *testing.T) {
+	e, dir := newTestExporter(t, ExportFormatNDJSON, true, 1)
+	next := exportTestAllocations[0]
+	next.Start, next.End = "2023-11-14T00:00:00Z", "2023-11-14T12:00:00Z"
+	assert.NoError(t, e.Record(nil, []Allocation{next}))
+	next.Start, next.End = "2023-11-14T12:00:00Z", "2023-11-15T00:00:00Z"
+	assert.NoError(t, e.Record(nil, []Allocation{next}))
+	f, err := os.Open(filepath.Join(dir, "2023-11-14.ndjson.gz"))
+	assert.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`{"cpu_cost":1,"namespace":"a","total_cost":1.5,"window_end":"2023-11-14T12:00:00Z","window_start":"2023-11-14T00:00:00Z"}`+"\n"+
+			`{"cpu_cost":1,"namespace":"a","total_cost":1.5,"window_end":"2023-11-15T00:00:00Z","window_start":"2023-11-14T12:00:00Z"}`+"\n",
+		string(b))
+
+	// Only the newest file is kept.
+	assert.NoError(t, e.Record(nil, exportTestAllocations[2:]))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "2023-11-15.ndjson.gz", entries[0].Name())
+}
+
+func TestExporterRecordColumnsChange(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		e, dir := newTestExporter(t, ExportFormatCSV, gz, 0)
+		assert.NoError(t, e.Record(nil, exportTestAllocations[:1]))
+		// The file is rewritten with the new header when a label is added.
+		v := NewTestConfig([]byte(strings.Replace(fmt.Sprintf(exportTestConfig, dir, ExportFormatCSV, gz, 0), `      key: namespace
+`, `      key: namespace
+    - name: team
+      key: labels.team
+`, 1)))
+		e.config = v
+		next := exportTestAllocations[0]
+		next.Name = "a/x"
+		next.Properties = map[string]any{"namespace": "a", "labels": map[string]any{"team": "x"}}
+		assert.NoError(t, e.Record(nil, []Allocation{next}))
+		var r io.Reader
+		f, err := os.Open(filepath.Join(dir, e.FileName("2023-11-14T00:00:00Z")))
+		assert.NoError(t, err)
+		r = f
+		if gz {
+			r, err = gzip.NewReader(f)
+			assert.NoError(t, err)
+		}
+		b, err := io.ReadAll(r)
+		f.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "window_start,window_end,namespace,team,total_cost,cpu_cost\n"+
+			"2023-11-14T00:00:00Z,2023-11-15T00:00:00Z,a,,1.5,1\n"+
+			"2023-11-14T00:00:00Z,2023-11-15T00:00:00Z,a,x,1.5,1\n", string(b))
+	}
+}
+
+func TestExporterRecordPartialFailure(t *testing.T) {
+	e, dir := newTestExporter(t, ExportFormatCSV, false, 0)
+	// The file of 2023-11-15 cannot be written.
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "2023-11-15.csv"), 0o755))
+	assert.ErrorIs(t, e.Record(nil, exportTestAllocations), ErrFailedExport)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "2023-11-15.csv")))
+	// Only the rows of the file which failed are retried.
+	assert.NoError(t, e.Record(nil, exportTestAllocations))
+	b, err := os.ReadFile(filepath.Join(dir, "2023-11-14.csv"))
+	assert.NoError(t, err)
+	assert.Equal(t, "window_start,window_end,namespace,total_cost,cpu_cost\n"+
+		"2023-11-14T00:00:00Z,2023-11-15T00:00:00Z,a,1.5,1\n", string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "2023-11-15.csv"))
+	assert.NoError(t, err)
+	assert.Equal(t, "window_start,window_end,namespace,total_cost,cpu_cost\n"+
+		"2023-11-15T00:00:00Z,2023-11-16T00:00:00Z,\"b,c\",3,0\n", string(b))
+}
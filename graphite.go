@@ -0,0 +1,143 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Graphite sink.
+//
+// After each cycle, the registry is gathered and its samples are sent to a
+// Graphite (Carbon) server using the plaintext protocol over TCP. The path of
+// each sample is rendered from a Go template (see text/template).
+//
+// For documentation on the plaintext protocol, see the following:
+//   - https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// ErrFailedGraphite is returned when samples cannot be sent to the Graphite
+// server.
+var ErrFailedGraphite = errors.New("Failed to send samples to Graphite")
+
+// Default path template, ex.
+//
+//	kubecost.experimental.total_cost.<label value>...
+//
+// Label values are in order of label name.
+const DefaultGraphitePath = "{{ .Namespace }}.{{ .Subsystem }}.{{ .Name }}" +
+	"{{ range $k, $v := .Labels }}.{{ $v }}{{ end }}"
+
+// Path node of empty label values. Empty label values are not removed from
+// the path, since label sets which only differ by which label is empty would
+// otherwise have the same path.
+const GraphiteEmptyNode = "_"
+
+var (
+	// Characters replaced in label values, since dots separate path nodes.
+	graphiteInvalidRegex = regexp.MustCompile(`[^a-zA-Z0-9_:\-]`)
+	// Empty path nodes (ex. an empty namespace or subsystem).
+	graphiteEmptyNodeRegex = regexp.MustCompile(`\.{2,}`)
+)
+
+// Sanitize a label value for use as a Graphite path node. Empty values are
+// replaced with GraphiteEmptyNode.
+func SanitizeGraphiteNode(s string) string {
+	if s == "" {
+		return GraphiteEmptyNode
+	}
+	return graphiteInvalidRegex.ReplaceAllString(s, "_")
+}
+
+// GraphiteWriter sends gathered samples to a Graphite server. It implements
+// the Recorder interface.
+type GraphiteWriter struct {
+	config   *viper.Viper
+	gatherer prometheus.Gatherer
+	address  string
+	timeout  time.Duration
+	path     *template.Template
+}
+
+// Create a new GraphiteWriter from configuration. Samples are gathered from g.
+func NewGraphiteWriter(v *viper.Viper, g prometheus.Gatherer) (*GraphiteWriter, error) {
+	address := v.GetString("graphite.address")
+	if address == "" {
+		return nil, errors.New("'graphite.address' is required")
+	}
+	timeout, err := ParseDuration(v.GetString("graphite.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'graphite.timeout' config: %v. Defaulting to 10s", err)
+		timeout = 10 * time.Second
+	}
+	path, err := ParseNameTemplate(v, "graphite.path", DefaultGraphitePath)
+	if err != nil {
+		return nil, err
+	}
+	return &GraphiteWriter{
+		config:   v,
+		gatherer: g,
+		address:  address,
+		timeout:  timeout,
+		path:     path,
+	}, nil
+}
+
+// Format a sample as a plaintext line, with the timestamp in seconds.
+//
+// Label values are sanitized before rendering the path. Remaining empty path
+// nodes (ex. an empty namespace) are removed from the rendered path.
+func (w *GraphiteWriter) format(s Sample, ts int64) (string, error) {
+	n := NewSinkName(w.config, s)
+	n.Labels = make(prometheus.Labels, len(s.Labels))
+	for k, v := range s.Labels {
+		n.Labels[k] = SanitizeGraphiteNode(v)
+	}
+	path, err := ExecuteNameTemplate(w.path, n)
+	if err != nil {
+		return "", err
+	}
+	path = strings.Trim(graphiteEmptyNodeRegex.ReplaceAllString(path, "."), ".")
+	path = strings.ReplaceAll(path, " ", "_")
+	return path + " " + strconv.FormatFloat(s.Value, 'f', -1, 64) + " " + strconv.FormatInt(ts, 10), nil
+}
+
+// Gather samples and send them to the Graphite server over a new TCP
+// connection. Samples are timestamped with the end of the window of the
+// allocations.
+func (w *GraphiteWriter) Record(_ AllocationAPI, as []Allocation) error {
+	samples, err := GatherSamples(w.gatherer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedGraphite, err)
+	}
+	ts := GetWindowEnd(as).Unix()
+	conn, err := net.DialTimeout("tcp", w.address, w.timeout)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedGraphite, err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	bw := bufio.NewWriter(conn)
+	for _, s := range samples {
+		l, err := w.format(s, ts)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrFailedGraphite, err)
+		}
+		bw.WriteString(l + "\n")
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedGraphite, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeGraphiteNode(t *testing.T) {
+	assert.Equal(t, "app_kubernetes_io_name", SanitizeGraphiteNode("app.kubernetes.io/name"))
+	assert.Equal(t, "a-b_c:d", SanitizeGraphiteNode("a-b_c:d"))
+	assert.Equal(t, "_", SanitizeGraphiteNode(""))
+}
+
+func TestGraphiteWriterFormat(t *testing.T) {
+	cases := []struct {
+		config string
+		name   string
+		want   string
+	}{
+		{
+			config: `metrics:
+  namespace: kubecost
+graphite:
+  address: carbon:2003`,
+			name: "kubecost_total_cost",
+			want: "kubecost.total_cost._.ns_1.web 1.5 1700000000",
+		},
+		{
+			config: `metrics:
+  namespace: kubecost
+  subsystem: experimental
+graphite:
+  address: carbon:2003
+  path: "chargeback.{{ .Labels.namespace }}.{{ .Labels.team }}.{{ .Name }}"`,
+			name: "kubecost_experimental_total_cost",
+			want: "chargeback.ns_1.total_cost 1.5 1700000000",
+		},
+	}
+	for _, c := range cases {
+		w, err := NewGraphiteWriter(NewTestConfig([]byte(c.config)), prometheus.NewRegistry())
+		assert.NoError(t, err)
+		l, err := w.format(Sample{
+			Name:   c.name,
+			Type:   dto.MetricType_GAUGE,
+			Labels: prometheus.Labels{"namespace": "ns.1", "pod": "web", "container": ""},
+			Value:  1.5,
+		}, 1700000000)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, l)
+	}
+}
+
+func TestGraphiteWriterFormatEmptyLabels(t *testing.T) {
+	w, err := NewGraphiteWriter(NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+graphite:
+  address: carbon:2003`)), prometheus.NewRegistry())
+	assert.NoError(t, err)
+	// Label sets which only differ by which label is empty have distinct paths.
+	a, err := w.format(Sample{Name: "kubecost_total_cost", Labels: prometheus.Labels{"cluster": "", "namespace": "a"}}, 0)
+	assert.NoError(t, err)
+	b, err := w.format(Sample{Name: "kubecost_total_cost", Labels: prometheus.Labels{"cluster": "a", "namespace": ""}}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "kubecost.total_cost._.a 0 0", a)
+	assert.Equal(t, "kubecost.total_cost.a._ 0 0", b)
+}
+
+func TestGraphiteWriterRecord(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		got <- string(b)
+	}()
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "total_cost"}, []string{"namespace"})
+	r.MustRegister(g)
+	g.WithLabelValues("a").Set(1)
+	g.WithLabelValues("b").Set(2)
+	w, err := NewGraphiteWriter(NewTestConfig([]byte(`graphite:
+  address: `+ln.Addr().String())), r)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Record(nil, []Allocation{{End: "2023-11-14T22:13:20Z"}}))
+	assert.Equal(t, "total_cost.a 1 1700000000\ntotal_cost.b 2 1700000000\n", <-got)
+
+	ln.Close()
+	assert.ErrorIs(t, w.Record(nil, nil), ErrFailedGraphite)
+}
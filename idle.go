@@ -0,0 +1,280 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Handling of idle and unallocated allocations.
+//
+// Kubecost returns special allocations: __idle__ (the cost of unused cluster
+// resources) and __unallocated__ (allocations without a value for the
+// aggregation, ex. a missing Kubernetes label). Since their properties are
+// mostly empty, they may be dropped, exported as dedicated metrics, or, for
+// idle allocations, distributed across other allocations.
+//
+// For documentation on idle and unallocated costs, see the following:
+//   - https://docs.kubecost.com/apis/apis-overview/allocation
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// Names of the special allocations.
+const (
+	IdleAllocationName        = "__idle__"
+	UnallocatedAllocationName = "__unallocated__"
+)
+
+// Idle and unallocated handling modes.
+const (
+	// Handle as any other allocation.
+	IdleKeep = "keep"
+	// Drop the allocation.
+	IdleDrop = "drop"
+	// Export the allocation as dedicated metrics (ex. idle_total_cost).
+	IdleSeparate = "separate"
+	// Distribute the cost of idle allocations across the other allocations in
+	// the same group (ex. cluster). Not applicable to unallocated allocations.
+	IdleDistribute = "distribute"
+)
+
+// Query names, used to configure the handling mode of each query.
+const (
+	QueryMain          = "api"
+	QueryProjection    = "projection"
+	QueryBudgets       = "budgets"
+	QueryComparisons   = "comparisons"
+	QueryNotifications = "notifications"
+)
+
+// Allocation fields whose idle values are distributed. TotalCost is increased
+// by the sum of the distributed values.
+var IdleDistributionFields = []string{"CPUCost", "GPUCost", "RAMCost"}
+
+// Whether the allocation is an idle allocation. Idle allocations may be named
+// "__idle__" or, when aggregating by several properties, contain "__idle__" as
+// a path element (ex. cluster-one/__idle__).
+func IsIdle(a Allocation) bool {
+	return hasPathElement(a.Name, IdleAllocationName)
+}
+
+// Whether the allocation is an unallocated allocation.
+func IsUnallocated(a Allocation) bool {
+	return !IsIdle(a) && hasPathElement(a.Name, UnallocatedAllocationName)
+}
+
+// Whether the slash-separated name contains the element.
+func hasPathElement(name, elem string) bool {
+	return contains(strings.Split(name, "/"), elem)
+}
+
+// Get the handling modes of idle and unallocated allocations for a query.
+//
+// The idle mode defaults to "idle.mode", unless overridden in "idle.queries".
+// Since dedicated metrics are only exported for the main query, "separate" is
+// equivalent to "drop" for other queries.
+func GetIdleModes(v *viper.Viper, query string) (string, string) {
+	idle, unallocated := v.GetString("idle.mode"), v.GetString("idle.unallocated_mode")
+	if m := v.GetString("idle.queries." + query); m != "" {
+		idle = m
+	}
+	switch idle {
+	case IdleDrop, IdleSeparate, IdleDistribute:
+	default:
+		idle = IdleKeep
+	}
+	switch unallocated {
+	case IdleDrop, IdleSeparate:
+	default:
+		unallocated = IdleKeep
+	}
+	if query != QueryMain {
+		if idle == IdleSeparate {
+			idle = IdleDrop
+		}
+		if unallocated == IdleSeparate {
+			unallocated = IdleDrop
+		}
+	}
+	return idle, unallocated
+}
+
+// Handle idle and unallocated allocations of a query according to
+// configuration (see GetIdleModes).
+//
+// Returns the allocations to be passed on, and the idle and unallocated
+// allocations which were removed.
+func HandleIdleAllocations(v *viper.Viper, query string, as []Allocation) ([]Allocation, []Allocation, []Allocation) {
+	idleMode, unallocatedMode := GetIdleModes(v, query)
+	if idleMode == IdleKeep && unallocatedMode == IdleKeep {
+		return as, nil, nil
+	}
+	kept := make([]Allocation, 0, len(as))
+	var idle, unallocated []Allocation
+	for _, a := range as {
+		switch {
+		case IsIdle(a) && idleMode != IdleKeep:
+			idle = append(idle, a)
+		case IsUnallocated(a) && unallocatedMode != IdleKeep:
+			unallocated = append(unallocated, a)
+		default:
+			kept = append(kept, a)
+		}
+	}
+	if idleMode == IdleDistribute {
+		kept = DistributeIdle(kept, idle, v.GetString("idle.distribute_by"))
+	}
+	return kept, idle, unallocated
+}
+
+// Distribute the cost of idle allocations across the other allocations with
+// the same value of the property key (ex. cluster, node). An empty key
+// distributes across all allocations.
+//
+// The values of IdleDistributionFields are distributed in proportion to the
+// value of the same field of each allocation (ex. idle CPU cost by CPU cost),
+// or, if these are all 0, in proportion to TotalCost. Idle cost of groups
+// without other allocations is not distributed.
+//
+// The returned allocations are copies.
+func DistributeIdle(as []Allocation, idle []Allocation, key string) []Allocation {
+	out := make([]Allocation, len(as))
+	copy(out, as)
+	group := func(a Allocation) string {
+		if key == "" {
+			return ""
+		}
+		g, _ := GetElementFromKey(key, a.Properties).(string)
+		return g
+	}
+	members := map[string][]int{}
+	for i, a := range out {
+		g := group(a)
+		members[g] = append(members[g], i)
+	}
+	for _, ia := range idle {
+		ms := members[group(ia)]
+		for _, f := range IdleDistributionFields {
+			amount := ia.GetValueByFieldNameFloat(f)
+			if amount == 0 || len(ms) == 0 {
+				continue
+			}
+			weight := f
+			var total float64
+			for _, i := range ms {
+				total += out[i].GetValueByFieldNameFloat(f)
+			}
+			if total == 0 {
+				weight = "TotalCost"
+				for _, i := range ms {
+					total += out[i].TotalCost
+				}
+			}
+			if total == 0 {
+				continue
+			}
+			for _, i := range ms {
+				x := amount * out[i].GetValueByFieldNameFloat(weight) / total
+				addToField(&out[i], f, x)
+				out[i].TotalCost += x
+			}
+		}
+	}
+	return out
+}
+
+// Add x to the value of an Allocation field.
+func addToField(a *Allocation, field string, x float64) {
+	switch field {
+	case "CPUCost":
+		a.CPUCost += x
+	case "GPUCost":
+		a.GPUCost += x
+	case "RAMCost":
+		a.RAMCost += x
+	}
+}
+
+// An AllocationFilter modifies the allocations passed to subsequent Recorders.
+type AllocationFilter interface {
+	Filter(as []Allocation) []Allocation
+}
+
+// IdleMetrics handles idle and unallocated allocations of the main query, and
+// holds their dedicated metrics. It implements the Recorder,
+// AllocationFilter and prometheus.Collector interfaces.
+type IdleMetrics struct {
+	config      *viper.Viper
+	labels      []string
+	Idle        PrometheusMetrics
+	Unallocated PrometheusMetrics
+}
+
+// Create new IdleMetrics from configuration.
+//
+// For each element in "idle.names" (ex. total_cost), the following metrics are
+// generated with the label names in "idle.labels":
+//
+//   - idle_total_cost
+//   - unallocated_total_cost
+func NewIdleMetrics(v *viper.Viper) *IdleMetrics {
+	names := GetNameFieldMappings(v, "idle.names")
+	labels := v.GetStringSlice("idle.labels")
+	return &IdleMetrics{
+		config:      v,
+		labels:      labels,
+		Idle:        NewPrometheusMetricsWithLabelNames(v, names, "idle_", labels),
+		Unallocated: NewPrometheusMetricsWithLabelNames(v, names, "unallocated_", labels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *IdleMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.Idle.Describe(ch)
+	m.Unallocated.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *IdleMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.Idle.Collect(ch)
+	m.Unallocated.Collect(ch)
+}
+
+// Update the dedicated metrics, if the handling mode of the main query is
+// "separate". Values of allocations with the same labels are summed. Label
+// values are retrieved from the allocation properties, using the label names
+// as keys. Metrics are reset on each update.
+func (m *IdleMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	idleMode, unallocatedMode := GetIdleModes(m.config, QueryMain)
+	_, idle, unallocated := HandleIdleAllocations(m.config, QueryMain, as)
+	if idleMode == IdleSeparate {
+		m.set(m.Idle, idle)
+	}
+	if unallocatedMode == IdleSeparate {
+		m.set(m.Unallocated, unallocated)
+	}
+	return nil
+}
+
+// Reset metrics and set them to the summed values of the allocations.
+func (m *IdleMetrics) set(metrics PrometheusMetrics, as []Allocation) {
+	for field, metric := range metrics {
+		metric.Reset()
+		for _, a := range as {
+			ls := prometheus.Labels{}
+			for _, l := range m.labels {
+				ls[l], _ = GetElementFromKey(l, a.Properties).(string)
+			}
+			metric.With(ls).Add(a.GetValueByFieldNameFloat(field))
+		}
+	}
+}
+
+// Filter implements AllocationFilter. Idle and unallocated allocations are
+// removed or distributed according to the handling modes of the main query.
+func (m *IdleMetrics) Filter(as []Allocation) []Allocation {
+	kept, _, _ := HandleIdleAllocations(m.config, QueryMain, as)
+	return kept
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsIdle(t *testing.T) {
+	cases := []struct {
+		name            string
+		wantIdle        bool
+		wantUnallocated bool
+	}{
+		{name: "__idle__", wantIdle: true},
+		{name: "cluster-one/__idle__", wantIdle: true},
+		{name: "__unallocated__", wantUnallocated: true},
+		{name: "cluster-one/__unallocated__/pod", wantUnallocated: true},
+		{name: "idle"},
+		{name: "my__idle__pod"},
+	}
+	for _, c := range cases {
+		a := Allocation{Name: c.name}
+		assert.Equal(t, c.wantIdle, IsIdle(a), c.name)
+		assert.Equal(t, c.wantUnallocated, IsUnallocated(a), c.name)
+	}
+}
+
+func TestGetIdleModes(t *testing.T) {
+	v := NewTestConfig([]byte(`idle:
+  mode: separate
+  unallocated_mode: separate
+  queries:
+    budgets: distribute
+`))
+	cases := []struct {
+		query           string
+		wantIdle        string
+		wantUnallocated string
+	}{
+		{query: QueryMain, wantIdle: IdleSeparate, wantUnallocated: IdleSeparate},
+		{query: QueryBudgets, wantIdle: IdleDistribute, wantUnallocated: IdleDrop},
+		{query: QueryProjection, wantIdle: IdleDrop, wantUnallocated: IdleDrop},
+	}
+	for _, c := range cases {
+		idle, unallocated := GetIdleModes(v, c.query)
+		assert.Equal(t, c.wantIdle, idle, c.query)
+		assert.Equal(t, c.wantUnallocated, unallocated, c.query)
+	}
+	idle, unallocated := GetIdleModes(NewTestConfig([]byte(`idle:
+  mode: invalid
+`)), QueryMain)
+	assert.Equal(t, IdleKeep, idle)
+	assert.Equal(t, IdleKeep, unallocated)
+}
+
+func TestDistributeIdle(t *testing.T) {
+	as := []Allocation{
+		{Name: "a", Properties: map[string]any{"cluster": "x"}, CPUCost: 1, RAMCost: 0, TotalCost: 1},
+		{Name: "b", Properties: map[string]any{"cluster": "x"}, CPUCost: 3, RAMCost: 0, TotalCost: 3},
+		{Name: "c", Properties: map[string]any{"cluster": "y"}, CPUCost: 1, TotalCost: 1},
+	}
+	idle := []Allocation{
+		{Name: "x/__idle__", Properties: map[string]any{"cluster": "x"}, CPUCost: 4, RAMCost: 2, TotalCost: 6},
+		{Name: "z/__idle__", Properties: map[string]any{"cluster": "z"}, CPUCost: 10, TotalCost: 10},
+	}
+	out := DistributeIdle(as, idle, "cluster")
+	// CPU cost is distributed by CPU cost. RAM cost is distributed by total
+	// cost, since RAM cost is 0.
+	assert.Equal(t, 2.0, out[0].CPUCost)
+	assert.Equal(t, 0.5, out[0].RAMCost)
+	assert.Equal(t, 2.5, out[0].TotalCost)
+	assert.Equal(t, 6.0, out[1].CPUCost)
+	assert.Equal(t, 7.5, out[1].TotalCost)
+	// Idle cost of clusters without other allocations is not distributed.
+	assert.Equal(t, 1.0, out[2].TotalCost)
+	// Allocations are copied.
+	assert.Equal(t, 1.0, as[0].TotalCost)
+}
+
+func TestIdleMetrics(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+idle:
+  mode: separate
+  unallocated_mode: drop
+  labels: [cluster]
+  names:
+    - name: total_cost
+      field: TotalCost
+`))
+	m := NewIdleMetrics(v)
+	as := []Allocation{
+		{Name: "a", TotalCost: 1},
+		{Name: "x/__idle__", Properties: map[string]any{"cluster": "x"}, TotalCost: 2},
+		{Name: "y/__idle__", Properties: map[string]any{"cluster": "y"}, TotalCost: 3},
+		{Name: "__unallocated__", TotalCost: 4},
+	}
+	assert.NoError(t, m.Record(nil, as))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.Idle, "kubecost_idle_total_cost"))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.Idle["TotalCost"].WithLabelValues("y")))
+	assert.Equal(t, 0, testutil.CollectAndCount(m.Unallocated))
+	assert.Equal(t, []Allocation{as[0]}, m.Filter(as))
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// InfluxDB sink.
+//
+// After each cycle, the registry is gathered and its samples are written to
+// the InfluxDB HTTP write API in line protocol. The measurement of each sample
+// is rendered from a Go template (see text/template), its labels become tags,
+// and its value is written to a single field. Both the InfluxDB 1.x (/write)
+// and 2.x (/api/v2/write) APIs are supported.
+//
+// For documentation on the line protocol, see the following:
+//   - https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// ErrFailedInfluxDBWrite is returned when an error or bad response is returned
+// by the InfluxDB write API.
+var ErrFailedInfluxDBWrite = errors.New("Failed to write points to InfluxDB")
+
+// Default measurement template.
+const DefaultInfluxDBMeasurement = "{{ .FullName }}"
+
+// Escape characters with special meaning in the line protocol.
+var (
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagReplacer         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// InfluxDBWriter writes gathered samples to InfluxDB. It implements the
+// Recorder interface.
+type InfluxDBWriter struct {
+	config      *viper.Viper
+	gatherer    prometheus.Gatherer
+	client      *http.Client
+	url         string
+	token       string
+	username    string
+	password    string
+	measurement *template.Template
+	field       string
+	maxLines    int
+}
+
+// Create a new InfluxDBWriter from configuration. Samples are gathered from g.
+//
+// The InfluxDB 2.x API is used if "influxdb.bucket" is set, otherwise the
+// InfluxDB 1.x API is used with "influxdb.database".
+func NewInfluxDBWriter(v *viper.Viper, g prometheus.Gatherer) (*InfluxDBWriter, error) {
+	base := strings.TrimSuffix(v.GetString("influxdb.url"), "/")
+	if base == "" {
+		return nil, errors.New("'influxdb.url' is required")
+	}
+	params := url.Values{"precision": {"s"}}
+	switch {
+	case v.GetString("influxdb.bucket") != "":
+		base += "/api/v2/write"
+		params.Set("bucket", v.GetString("influxdb.bucket"))
+		params.Set("org", v.GetString("influxdb.org"))
+	case v.GetString("influxdb.database") != "":
+		base += "/write"
+		params.Set("db", v.GetString("influxdb.database"))
+		if rp := v.GetString("influxdb.retention_policy"); rp != "" {
+			params.Set("rp", rp)
+		}
+	default:
+		return nil, errors.New("One of 'influxdb.bucket' or 'influxdb.database' is required")
+	}
+	timeout, err := ParseDuration(v.GetString("influxdb.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'influxdb.timeout' config: %v. Defaulting to 10s", err)
+		timeout = 10 * time.Second
+	}
+	measurement, err := ParseNameTemplate(v, "influxdb.measurement", DefaultInfluxDBMeasurement)
+	if err != nil {
+		return nil, err
+	}
+	w := &InfluxDBWriter{
+		config:      v,
+		gatherer:    g,
+		client:      &http.Client{Timeout: timeout},
+		url:         base + "?" + params.Encode(),
+		token:       v.GetString("influxdb.token"),
+		username:    v.GetString("influxdb.username"),
+		password:    v.GetString("influxdb.password"),
+		measurement: measurement,
+		field:       v.GetString("influxdb.field"),
+		maxLines:    v.GetInt("influxdb.max_lines_per_request"),
+	}
+	if w.field == "" {
+		w.field = "value"
+	}
+	if w.maxLines <= 0 {
+		w.maxLines = 5000
+	}
+	return w, nil
+}
+
+// Format a sample as a line of line protocol, with the timestamp in seconds.
+// Tags are sorted by key, and tags with an empty value are omitted.
+func (w *InfluxDBWriter) format(s Sample, ts int64) (string, error) {
+	measurement, err := ExecuteNameTemplate(w.measurement, NewSinkName(w.config, s))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString(influxMeasurementReplacer.Replace(measurement))
+	for _, n := range s.LabelNames() {
+		if s.Labels[n] == "" {
+			continue
+		}
+		b.WriteString("," + influxTagReplacer.Replace(n) + "=" + influxTagReplacer.Replace(s.Labels[n]))
+	}
+	b.WriteString(" " + influxTagReplacer.Replace(w.field) + "=" + strconv.FormatFloat(s.Value, 'f', -1, 64))
+	b.WriteString(" " + strconv.FormatInt(ts, 10))
+	return b.String(), nil
+}
+
+// Gather samples and write them to InfluxDB, in requests of at most
+// "max_lines_per_request" lines. Points are timestamped with the end of the
+// window of the allocations.
+func (w *InfluxDBWriter) Record(_ AllocationAPI, as []Allocation) error {
+	samples, err := GatherSamples(w.gatherer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedInfluxDBWrite, err)
+	}
+	ts := GetWindowEnd(as).Unix()
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		l, err := w.format(s, ts)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrFailedInfluxDBWrite, err)
+		}
+		lines = append(lines, l)
+	}
+	for i := 0; i < len(lines); i += w.maxLines {
+		end := i + w.maxLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if err := w.send(strings.Join(lines[i:end], "\n")); err != nil {
+			return fmt.Errorf("%w: %v", ErrFailedInfluxDBWrite, err)
+		}
+	}
+	return nil
+}
+
+// Send a request to the write API.
+func (w *InfluxDBWriter) send(body string) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
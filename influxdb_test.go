@@ -0,0 +1,100 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSinkName(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  subsystem: experimental`))
+	n := NewSinkName(v, Sample{Name: "kubecost_experimental_total_cost"})
+	assert.Equal(t, "total_cost", n.Name)
+	assert.Equal(t, "kubecost_experimental_total_cost", n.FullName)
+	n = NewSinkName(v, Sample{Name: "go_goroutines"})
+	assert.Equal(t, "go_goroutines", n.Name)
+}
+
+func TestInfluxDBWriterFormat(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+influxdb:
+  url: http://influxdb:8086
+  database: chargeback
+  measurement: "{{ .Namespace }}_{{ .Name }}"`))
+	w, err := NewInfluxDBWriter(v, prometheus.NewRegistry())
+	assert.NoError(t, err)
+	assert.Equal(t, "http://influxdb:8086/write?db=chargeback&precision=s", w.url)
+	l, err := w.format(Sample{
+		Name:   "kubecost_total_cost",
+		Type:   dto.MetricType_GAUGE,
+		Labels: prometheus.Labels{"pod": "", "namespace": "a b", "team": "x,y=z"},
+		Value:  1.5,
+	}, 1700000000)
+	assert.NoError(t, err)
+	assert.Equal(t, `kubecost_total_cost,namespace=a\ b,team=x\,y\=z value=1.5 1700000000`, l)
+
+	_, err = NewInfluxDBWriter(NewTestConfig([]byte(`influxdb:
+  url: http://influxdb:8086`)), prometheus.NewRegistry())
+	assert.Error(t, err)
+	_, err = NewInfluxDBWriter(NewTestConfig([]byte(`influxdb:
+  url: http://influxdb:8086
+  database: chargeback
+  measurement: "{{ .Name"`)), prometheus.NewRegistry())
+	assert.Error(t, err)
+}
+
+func TestInfluxDBWriterRecord(t *testing.T) {
+	Now = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { Now = time.Now }()
+	bodies := []string{}
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "acme", r.URL.Query().Get("org"))
+		assert.Equal(t, "costs", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "s", r.URL.Query().Get("precision"))
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "total_cost"}, []string{"namespace"})
+	r.MustRegister(g)
+	for _, ns := range []string{"a", "b", "c"} {
+		g.WithLabelValues(ns).Set(1)
+	}
+	v := NewTestConfig([]byte(`influxdb:
+  url: ` + srv.URL + `
+  org: acme
+  bucket: costs
+  token: secret
+  max_lines_per_request: 2`))
+	w, err := NewInfluxDBWriter(v, r)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Record(nil, nil))
+	assert.Equal(t, []string{
+		"total_cost,namespace=a value=1 1700000000\ntotal_cost,namespace=b value=1 1700000000",
+		"total_cost,namespace=c value=1 1700000000",
+	}, bodies)
+
+	status = http.StatusBadRequest
+	err = w.Record(nil, nil)
+	assert.ErrorIs(t, err, ErrFailedInfluxDBWrite)
+	assert.True(t, strings.Contains(err.Error(), "400"))
+}
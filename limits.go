@@ -0,0 +1,153 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Cardinality limiting of Prometheus metrics.
+//
+// High-cardinality labels (ex. pod names, Kubernetes labels) may result in
+// more series than a metrics backend accepts. Each metric may be limited to
+// the top N label sets by an Allocation field, with the remainder aggregated
+// into a single series whose label values are "__other__", and to a hard
+// maximum number of series, beyond which series are dropped.
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Label value of the series into which label sets beyond the top N are
+// aggregated.
+const OtherLabelValue = "__other__"
+
+// A SeriesLimit limits the number of series of a metric. Zero values disable
+// the corresponding limit.
+type SeriesLimit struct {
+	// Number of label sets to keep. The remainder is aggregated into a single
+	// series.
+	TopN int
+	// Allocation field by which label sets are ranked (ex. TotalCost).
+	By string
+	// Maximum number of series, including the "__other__" series.
+	MaxSeries int
+}
+
+// Whether any limit is enabled.
+func (l SeriesLimit) Enabled() bool {
+	return l.TopN > 0 || l.MaxSeries > 0
+}
+
+// Get series limits from configuration by Allocation field name.
+//
+// Limits in "metrics.limits" apply to every metric in "metrics.names". Each
+// element in "metrics.names" may override them with "top_n", "by" and
+// "max_series" keys.
+func GetSeriesLimits(v *viper.Viper) map[string]SeriesLimit {
+	def := SeriesLimit{
+		TopN:      v.GetInt("metrics.limits.top_n"),
+		By:        v.GetString("metrics.limits.by"),
+		MaxSeries: v.GetInt("metrics.limits.max_series"),
+	}
+	if def.By == "" {
+		def.By = "TotalCost"
+	}
+	ns, _ := v.Get("metrics.names").([]any)
+	limits := make(map[string]SeriesLimit, len(ns))
+	for _, n := range ns {
+		m := n.(map[string]any)
+		l := def
+		if x, ok := m["top_n"]; ok {
+			l.TopN = cast.ToInt(x)
+		}
+		if x, ok := m["by"].(string); ok && x != "" {
+			l.By = x
+		}
+		if x, ok := m["max_series"]; ok {
+			l.MaxSeries = cast.ToInt(x)
+		}
+		limits[GetElementOrZeroValue[string]("field", m)] = l
+	}
+	return limits
+}
+
+// Apply a series limit to the values of field.
+//
+// Label sets are ranked by the value of the "By" field in descending order
+// (ties are broken by label set), so the same label sets are kept for all
+// metrics ranked by the same field. The label sets beyond the top N are
+// aggregated into a single "__other__" series using the aggregation function
+// of field (see GetAggregations), then the lowest ranked series beyond the
+// maximum are dropped. The "__other__" series is never dropped. Returns the
+// remaining series and the number of dropped series.
+//
+// The returned "__other__" series only holds a value for field.
+func LimitSeries(ss []*LabelSetValues, field, fn string, l SeriesLimit) ([]*LabelSetValues, int) {
+	out := make([]*LabelSetValues, len(ss))
+	copy(out, ss)
+	if !l.Enabled() {
+		return out, 0
+	}
+	sort.Slice(out, func(i, j int) bool {
+		vi, vj := out[i].Values[l.By], out[j].Values[l.By]
+		if vi != vj {
+			return vi > vj
+		}
+		return GetLabelsKey(out[i].Labels) < GetLabelsKey(out[j].Labels)
+	})
+	var other *LabelSetValues
+	if l.TopN > 0 && len(out) > l.TopN {
+		other = &LabelSetValues{Labels: prometheus.Labels{}, Values: map[string]float64{}}
+		for k := range out[0].Labels {
+			other.Labels[k] = OtherLabelValue
+		}
+		other.Values[field], other.Minutes = AggregateSets(out[l.TopN:], field, fn)
+		out = out[:l.TopN]
+	}
+	var dropped int
+	if n := l.MaxSeries; n > 0 {
+		if other != nil {
+			n--
+		}
+		if len(out) > n {
+			dropped = len(out) - n
+			out = out[:n]
+		}
+	}
+	if other != nil {
+		out = append(out, other)
+	}
+	return out, dropped
+}
+
+// Aggregate the values of field of label sets using an aggregation function,
+// as Aggregator does. Averages are weighted by the minutes of each label set.
+// Returns the aggregated value and the total minutes.
+func AggregateSets(ss []*LabelSetValues, field, fn string) (float64, float64) {
+	var x, sum, minutes float64
+	for i, s := range ss {
+		v := s.Values[field]
+		switch fn {
+		case AggregationAvg:
+			x += v * s.Minutes
+			sum += v
+		case AggregationMax:
+			if i == 0 || v > x {
+				x = v
+			}
+		default:
+			x += v
+		}
+		minutes += s.Minutes
+	}
+	if fn == AggregationAvg && len(ss) > 0 {
+		if minutes > 0 {
+			x /= minutes
+		} else {
+			x = sum / float64(len(ss))
+		}
+	}
+	return x, minutes
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSeriesLimits(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+      top_n: 5
+    - name: cpu_cost
+      field: CPUCost
+      by: CPUCost
+      max_series: 10
+  limits:
+    top_n: 2
+`))
+	assert.Equal(t, map[string]SeriesLimit{
+		"TotalCost": {TopN: 5, By: "TotalCost"},
+		"CPUCost":   {TopN: 2, By: "CPUCost", MaxSeries: 10},
+	}, GetSeriesLimits(v))
+}
+
+func TestLimitSeries(t *testing.T) {
+	set := func(ns string, cost float64) *LabelSetValues {
+		return &LabelSetValues{
+			Labels: prometheus.Labels{"namespace": ns},
+			Values: map[string]float64{"TotalCost": cost, "CPUCost": cost / 2},
+		}
+	}
+	ss := []*LabelSetValues{set("a", 1), set("b", 4), set("c", 2), set("d", 3)}
+	cases := []struct {
+		name        string
+		limit       SeriesLimit
+		want        []string
+		wantOther   float64
+		wantDropped int
+	}{
+		{
+			name:  "disabled",
+			limit: SeriesLimit{By: "TotalCost"},
+			want:  []string{"a", "b", "c", "d"},
+		},
+		{
+			name:      "top_n",
+			limit:     SeriesLimit{TopN: 2, By: "TotalCost"},
+			want:      []string{"b", "d", OtherLabelValue},
+			wantOther: 1.5,
+		},
+		{
+			name:        "max_series",
+			limit:       SeriesLimit{MaxSeries: 3, By: "TotalCost"},
+			want:        []string{"b", "d", "c"},
+			wantDropped: 1,
+		},
+		{
+			name:        "top_n and max_series",
+			limit:       SeriesLimit{TopN: 2, MaxSeries: 2, By: "TotalCost"},
+			want:        []string{"b", OtherLabelValue},
+			wantOther:   1.5,
+			wantDropped: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, dropped := LimitSeries(ss, "CPUCost", AggregationSum, c.limit)
+			got := make([]string, len(out))
+			for i, s := range out {
+				got[i] = s.Labels["namespace"]
+			}
+			assert.Equal(t, c.want, got)
+			assert.Equal(t, c.wantDropped, dropped)
+			if got[len(got)-1] == OtherLabelValue {
+				assert.Equal(t, c.wantOther, out[len(out)-1].Values["CPUCost"])
+			}
+		})
+	}
+}
+
+func TestAggregateSets(t *testing.T) {
+	ss := []*LabelSetValues{
+		{Values: map[string]float64{"CPUEfficiency": 0.9}, Minutes: 30},
+		{Values: map[string]float64{"CPUEfficiency": 0.6}, Minutes: 60},
+	}
+	x, minutes := AggregateSets(ss, "CPUEfficiency", AggregationAvg)
+	assert.InDelta(t, 0.7, x, 1e-9)
+	assert.Equal(t, 90.0, minutes)
+	x, _ = AggregateSets(ss, "CPUEfficiency", AggregationMax)
+	assert.Equal(t, 0.9, x)
+	x, _ = AggregateSets(ss, "CPUEfficiency", AggregationSum)
+	assert.Equal(t, 1.5, x)
+	// Averages are unweighted if minutes are 0.
+	ss[0].Minutes, ss[1].Minutes = 0, 0
+	x, _ = AggregateSets(ss, "CPUEfficiency", AggregationAvg)
+	assert.InDelta(t, 0.75, x, 1e-9)
+}
+
+func TestAllocationMetricsRecordLimits(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  names:
+    - name: total_cost
+      field: TotalCost
+      top_n: 1
+    - name: cpu_cost
+      field: CPUCost
+      max_series: 2
+  labels:
+    - name: namespace
+      key: "namespace"
+`))
+	m := NewAllocationMetrics(v)
+	as := []Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 1, CPUCost: 1},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 3, CPUCost: 2},
+		{Properties: map[string]any{"namespace": "c"}, TotalCost: 2, CPUCost: 3},
+	}
+	assert.NoError(t, m.Record(nil, as))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.Metrics["TotalCost"]))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("b")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues(OtherLabelValue)))
+	// Series are ranked by TotalCost by default.
+	assert.Equal(t, 2, testutil.CollectAndCount(m.Metrics["CPUCost"]))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.Metrics["CPUCost"].WithLabelValues("c")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Dropped.WithLabelValues("cpu_cost")))
+	assert.NoError(t, m.Record(nil, as))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Dropped.WithLabelValues("cpu_cost")))
+}
+
+func TestAllocationMetricsRecordLimitsAvg(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  names:
+    - name: cpu_efficiency
+      field: CPUEfficiency
+      top_n: 1
+  labels:
+    - name: namespace
+      key: "namespace"
+`))
+	m := NewAllocationMetrics(v)
+	as := []Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 3, CPUEfficiency: 0.5, Minutes: 60},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 2, CPUEfficiency: 0.9, Minutes: 30},
+		{Properties: map[string]any{"namespace": "c"}, TotalCost: 1, CPUEfficiency: 0.6, Minutes: 60},
+	}
+	assert.NoError(t, m.Record(nil, as))
+	// Efficiencies beyond the top N are averaged, weighted by minutes.
+	assert.InDelta(t, 0.7, testutil.ToFloat64(m.Metrics["CPUEfficiency"].WithLabelValues(OtherLabelValue)), 1e-9)
+}
@@ -36,8 +36,73 @@ func init() {
 	}
 }
 
+// A Recorder records cost allocation data once per cycle (ex. by updating
+// metrics).
+//
+// Recorders are passed the AllocationAPI, so that additional queries (ex. for
+// a different window) can be made, and the allocations retrieved during the
+// cycle.
+type Recorder interface {
+	Record(c AllocationAPI, as []Allocation) error
+}
+
+// Retrieve cost allocation data for the window between start and end.
+//
+// With exception of "window", the configured query parameters are used. Idle
+// and unallocated allocations are handled according to the handling modes of
+// the query (see GetIdleModes).
+func GetAllocationForWindow(c AllocationAPI, v *viper.Viper, query string, start, end time.Time) ([]Allocation, error) {
+	host, port, path := v.GetString("api.host"), v.GetInt("api.port"), v.GetString("api.path")
+	params := map[string]any{}
+	for k, p := range v.GetStringMap("api.parameters") {
+		params[k] = p
+	}
+	params["window"] = FormatWindow(start, end)
+	as, err := c.GetAllocation(c.GetURL(host, port, path, params))
+	if err != nil {
+		return nil, err
+	}
+	as, _, _ = HandleIdleAllocations(v, query, as)
+	return as, nil
+}
+
+// Retrieve cost allocation data from url and call each Recorder in order.
+//
+// Recorders which implement AllocationFilter modify the allocations passed to
+// subsequent Recorders. Errors returned by Recorders are logged. An error is
+// returned if cost allocation data cannot be retrieved.
+func RecordOnce(c AllocationAPI, url string, rs ...Recorder) error {
+	errs, err := recordOnce(c, url, rs...)
+	for _, err := range errs {
+		logger.Printf("%s\n", err)
+	}
+	return err
+}
+
+// Retrieve cost allocation data from url and call each Recorder in order (see
+// RecordOnce). Returns the errors returned by Recorders, and an error if cost
+// allocation data cannot be retrieved.
+func recordOnce(c AllocationAPI, url string, rs ...Recorder) ([]error, error) {
+	as, err := c.GetAllocation(url)
+	if err != nil {
+		return nil, err
+	}
+	errs := []error{}
+	for _, r := range rs {
+		if err := r.Record(c, as); err != nil {
+			errs = append(errs, err)
+		}
+		if f, ok := r.(AllocationFilter); ok {
+			as = f.Filter(as)
+		}
+	}
+	return errs, nil
+}
+
 // Retrieve cost allocation data and update metrics.
-func RecordMetrics(c AllocationAPI, metrics PrometheusMetrics) {
+//
+// Each Recorder is called in order once per cycle (see RecordOnce).
+func RecordMetrics(c AllocationAPI, rs ...Recorder) {
 	host, port, path, params := Config.GetString("api.host"), Config.GetInt("api.port"),
 		Config.GetString("api.path"), Config.GetStringMap("api.parameters")
 	url := c.GetURL(host, port, path, params)
@@ -49,28 +114,9 @@ func RecordMetrics(c AllocationAPI, metrics PrometheusMetrics) {
 	ticker := time.NewTicker(i)
 	go func() {
 		for {
-			as, err := c.GetAllocation(url)
-			if err != nil {
+			if err := RecordOnce(c, url, rs...); err != nil {
 				logger.Printf("%s\n", err)
 			}
-			for _, a := range as {
-				// Allocation properties are used to set Prometheus metric label
-				// values.
-				lvs := a.Properties
-				// 'name' is the Allocation struct field name for the corresponding
-				// Prometheus metric.
-				for name, metric := range metrics {
-					ls := NewPrometheusLabelsFromValues(Config, lvs)
-					m, err := metric.GetMetricWith(ls)
-					if err != nil {
-						logger.Printf(
-							"Number of label values is not the same as the number of "+
-								"variable labels in Desc: %s\n", err)
-						continue
-					}
-					m.Set(a.GetValueByFieldNameFloat(name))
-				}
-			}
 			<-ticker.C
 		}
 	}()
@@ -80,20 +126,181 @@ func main() {
 	c := AllocationAPIClient{
 		Client: &http.Client{},
 	}
+	// Validate relabel configs, label allowlists and the mapping file, since
+	// they are otherwise ignored if invalid.
+	if _, err := GetRelabelConfigs(Config); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := GetLabelAllowlists(Config); err != nil {
+		log.Fatal(err)
+	}
+	if Config.GetBool("mapping.enabled") {
+		if _, err := NewMapping(Config); err != nil {
+			log.Fatal(err)
+		}
+	}
 	// NewRegistry creates a new vanilla Registry without any Collectors
 	// pre-registered (see promhttp.Handler() for default Collectors).
 	r := prometheus.NewRegistry()
 	handler := promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+	// Handle idle and unallocated allocations before any other Recorder.
+	rs := []Recorder{}
+	if idle, unallocated := GetIdleModes(Config, QueryMain); idle != IdleKeep || unallocated != IdleKeep {
+		im := NewIdleMetrics(Config)
+		r.MustRegister(im)
+		rs = append(rs, im)
+	}
 	// Generate Prometheus metrics from configuration.
-	metrics := NewPrometheusMetrics(Config)
-	for _, m := range metrics {
-		r.MustRegister(m)
+	metrics := NewAllocationMetrics(Config)
+	r.MustRegister(metrics)
+	// Generate optional metrics derived from cost allocation data. These are
+	// updated after the metrics above.
+	rs = append(rs, metrics)
+	if Config.GetBool("mapping.enabled") {
+		mm := NewMappingMetrics(Config)
+		r.MustRegister(mm)
+		rs = append(rs, mm)
+	}
+	if Config.GetBool("rollups.enabled") {
+		ru := NewRollupMetrics(Config)
+		r.MustRegister(ru)
+		rs = append(rs, ru)
+	}
+	if Config.GetBool("shares.enabled") {
+		sh := NewShareMetrics(Config)
+		r.MustRegister(sh)
+		rs = append(rs, sh)
+	}
+	if Config.GetBool("shared_costs.enabled") {
+		sc, err := NewSharedCostMetrics(Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.MustRegister(sc)
+		rs = append(rs, sc)
+	}
+	if Config.GetBool("projection.enabled") {
+		p := NewProjectionMetrics(Config)
+		r.MustRegister(p)
+		rs = append(rs, p)
+	}
+	if Config.GetBool("budgets.enabled") {
+		b := NewBudgetMetrics(Config)
+		r.MustRegister(b)
+		rs = append(rs, b)
+	}
+	if Config.GetBool("comparisons.enabled") {
+		cm, err := NewComparisonMetrics(Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.MustRegister(cm)
+		rs = append(rs, cm)
+	}
+	if Config.GetBool("anomaly.enabled") {
+		a := NewAnomalyMetrics(Config)
+		r.MustRegister(a)
+		rs = append(rs, a)
+	}
+	if Config.GetBool("notifications.enabled") {
+		n, err := NewNotifier(Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, n)
+	}
+	if Config.GetBool("export.enabled") {
+		e, err := NewExporter(Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, e)
+	}
+	if Config.GetBool("parquet.enabled") {
+		e, err := NewParquetExporter(Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, e)
+	}
+	if Config.GetBool("database.enabled") {
+		w, err := NewDatabaseWriter(Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, w)
+	}
+	var rest *RESTHandler
+	if Config.GetBool("rest.enabled") {
+		rest = NewRESTHandler(Config)
+		rs = append(rs, rest)
+	}
+	// Sinks push the metrics of the registry after all other Recorders.
+	if Config.GetBool("remote_write.enabled") {
+		w, err := NewRemoteWriter(Config, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, w)
+	}
+	if Config.GetBool("otlp.enabled") {
+		e, err := NewOTLPExporter(Config, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, e)
+	}
+	if Config.GetBool("statsd.enabled") {
+		s, err := NewStatsDSink(Config, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, s)
+	}
+	if Config.GetBool("influxdb.enabled") {
+		w, err := NewInfluxDBWriter(Config, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, w)
+	}
+	if Config.GetBool("graphite.enabled") {
+		w, err := NewGraphiteWriter(Config, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, w)
+	}
+	// In run-once mode, metrics are updated once and pushed to a Pushgateway.
+	// The exit code is non-zero on failure.
+	if Config.GetBool("pushgateway.enabled") {
+		if err := RunOnce(c, Config, r, rs...); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 	// Retrieve data from the Kubecost Allocation API and update metrics.
-	RecordMetrics(c, metrics)
-	// Register metrics HTTP endpoint and handle requests on incoming
-	// connections.
-	pattern, port := Config.GetString("server.path"), fmt.Sprintf(":%s", Config.GetString("server.port"))
-	http.Handle(pattern, handler)
-	log.Fatal(http.ListenAndServe(port, nil))
+	RecordMetrics(c, rs...)
+	// Register HTTP endpoints and handle requests on incoming connections.
+	// The HTTP metrics endpoint may be disabled when metrics are pushed by
+	// sinks, while the REST API and the proxy are registered independently.
+	serve := false
+	if Config.GetBool("server.enabled") {
+		http.Handle(Config.GetString("server.path"), handler)
+		serve = true
+	}
+	if rest != nil {
+		http.Handle(Config.GetString("rest.path"), rest)
+		serve = true
+	}
+	if Config.GetBool("proxy.enabled") {
+		p := NewAllocationProxy(Config, c)
+		r.MustRegister(p)
+		http.Handle(Config.GetString("proxy.path"), p)
+		serve = true
+	}
+	if !serve {
+		select {}
+	}
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", Config.GetString("server.port")), nil))
 }
@@ -0,0 +1,322 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Ownership mapping of allocations to teams, cost centers and products.
+//
+// Namespaces do not map 1:1 to teams. A mapping file (CSV or YAML) holds
+// rules which match allocations by namespace, Kubernetes label or controller,
+// and add "team", "cost_center" and "product" labels to every series. The
+// file is reloaded when it changes.
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// Label names added by the mapping.
+var MappingLabelNames = []string{"team", "cost_center", "product"}
+
+// Mapping rule types.
+const (
+	// Match the namespace exactly.
+	MappingNamespace = "namespace"
+	// Match a Kubernetes label, where the match is "<key>=<value>".
+	MappingLabel = "label"
+	// Match the controller name against a regular expression, anchored on both
+	// ends.
+	MappingController = "controller"
+)
+
+// A MappingRule maps allocations to an owner.
+type MappingRule struct {
+	Type       string
+	Match      string
+	Team       string
+	CostCenter string
+	Product    string
+	regex      *regexp.Regexp
+}
+
+// Whether the rule matches the properties of an allocation.
+func (r MappingRule) Matches(m map[string]any) bool {
+	switch r.Type {
+	case MappingNamespace:
+		ns, _ := m["namespace"].(string)
+		return ns == r.Match
+	case MappingLabel:
+		k, v, _ := strings.Cut(r.Match, "=")
+		ls, _ := m["labels"].(map[string]any)
+		lv, ok := ls[k].(string)
+		return ok && lv == v
+	case MappingController:
+		c, _ := m["controller"].(string)
+		return r.regex.MatchString(c)
+	}
+	return false
+}
+
+// Create a new MappingRule from a map of column or key names to values.
+func NewMappingRule(m map[string]string) (MappingRule, error) {
+	r := MappingRule{
+		Type:       strings.ToLower(strings.TrimSpace(m["type"])),
+		Match:      strings.TrimSpace(m["match"]),
+		Team:       strings.TrimSpace(m["team"]),
+		CostCenter: strings.TrimSpace(m["cost_center"]),
+		Product:    strings.TrimSpace(m["product"]),
+	}
+	switch r.Type {
+	case MappingNamespace:
+	case MappingLabel:
+		if !strings.Contains(r.Match, "=") {
+			return r, fmt.Errorf("Invalid label match '%s': expected '<key>=<value>'", r.Match)
+		}
+	case MappingController:
+		var err error
+		if r.regex, err = regexp.Compile("^(?:" + r.Match + ")$"); err != nil {
+			return r, fmt.Errorf("Invalid controller match '%s': %w", r.Match, err)
+		}
+	default:
+		return r, fmt.Errorf("Unknown mapping rule type '%s'", r.Type)
+	}
+	return r, nil
+}
+
+// Read mapping rules from a file.
+//
+// CSV files (.csv) must have a header row with the columns "type", "match",
+// "team", "cost_center" and "product". YAML files (.yaml, .yml) must have a
+// "rules" key holding a list of maps with the same keys.
+func ReadMappingRules(path string) ([]MappingRule, error) {
+	var rows []map[string]string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading mapping file '%s': %w", path, err)
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, rec := range records[1:] {
+			row := map[string]string{}
+			for i, col := range records[0] {
+				if i < len(rec) {
+					row[strings.TrimSpace(col)] = rec[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+	case ".yaml", ".yml":
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("Error reading mapping file '%s': %w", path, err)
+		}
+		items, _ := v.Get("rules").([]any)
+		for _, item := range items {
+			row := map[string]string{}
+			for k, val := range item.(map[string]any) {
+				row[k] = fmt.Sprint(val)
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported mapping file extension '%s'", ext)
+	}
+	rules := make([]MappingRule, len(rows))
+	for i, row := range rows {
+		r, err := NewMappingRule(row)
+		if err != nil {
+			return nil, fmt.Errorf("Mapping rule %d in '%s': %w", i, path, err)
+		}
+		rules[i] = r
+	}
+	return rules, nil
+}
+
+// A Mapping maps allocations to owners using the rules of a mapping file. The
+// file is reloaded when its modification time changes, at most once per
+// reload interval.
+type Mapping struct {
+	path     string
+	def      string
+	interval time.Duration
+	mu       sync.Mutex
+	checked  time.Time
+	modTime  time.Time
+	rules    []MappingRule
+}
+
+// Create a new Mapping from configuration. An error is returned if the
+// mapping file cannot be read.
+func NewMapping(v *viper.Viper) (*Mapping, error) {
+	m := newMapping(v)
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Create a new Mapping from configuration without reading the mapping file.
+func newMapping(v *viper.Viper) *Mapping {
+	interval, err := ParseDuration(v.GetString("mapping.reload_interval"))
+	if err != nil {
+		logger.Printf("Error parsing 'mapping.reload_interval' config: %v. Defaulting to 1m", err)
+		interval = time.Minute
+	}
+	def := v.GetString("mapping.default")
+	if def == "" {
+		def = "unmapped"
+	}
+	return &Mapping{path: v.GetString("mapping.path"), def: def, interval: interval}
+}
+
+// Reload the mapping file if it changed.
+func (m *Mapping) reload() error {
+	m.checked = Now()
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		return fmt.Errorf("Error reading mapping file: %w", err)
+	}
+	if fi.ModTime().Equal(m.modTime) {
+		return nil
+	}
+	rules, err := ReadMappingRules(m.path)
+	if err != nil {
+		return err
+	}
+	m.rules, m.modTime = rules, fi.ModTime()
+	return nil
+}
+
+// Get the owner labels of an allocation from its properties. Returns false if
+// no rule matches, in which case all labels are given the default value.
+//
+// Rules are evaluated in order, and the first matching rule is used. Empty
+// values of a matching rule are given the default value.
+func (m *Mapping) Labels(props map[string]any) (prometheus.Labels, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if Now().Sub(m.checked) >= m.interval {
+		// Previous rules are kept if the file cannot be read.
+		if err := m.reload(); err != nil {
+			logger.Printf("%s. Keeping previous mapping rules\n", err)
+		}
+	}
+	or := func(s string) string {
+		if s == "" {
+			return m.def
+		}
+		return s
+	}
+	for _, r := range m.rules {
+		if r.Matches(props) {
+			return prometheus.Labels{
+				"team":        or(r.Team),
+				"cost_center": or(r.CostCenter),
+				"product":     or(r.Product),
+			}, true
+		}
+	}
+	return prometheus.Labels{"team": m.def, "cost_center": m.def, "product": m.def}, false
+}
+
+// Mappings by configuration.
+var mappingCache sync.Map
+
+// Get the Mapping of a configuration, reading the mapping file on first use.
+// Returns nil if "mapping.enabled" is false.
+//
+// If the mapping file cannot be read, the error is logged and all allocations
+// are unmapped. The mapping file should be validated at startup using
+// NewMapping.
+func getCachedMapping(v *viper.Viper) *Mapping {
+	if !v.GetBool("mapping.enabled") {
+		return nil
+	}
+	if m, ok := mappingCache.Load(v); ok {
+		return m.(*Mapping)
+	}
+	m, err := NewMapping(v)
+	if err != nil {
+		logger.Printf("%s. All allocations are unmapped\n", err)
+		m = newMapping(v)
+		m.checked = Now()
+	}
+	actual, _ := mappingCache.LoadOrStore(v, m)
+	return actual.(*Mapping)
+}
+
+// MappingMetrics holds the self-metrics of the mapping. It implements both the
+// Recorder and prometheus.Collector interfaces.
+type MappingMetrics struct {
+	config *viper.Viper
+	// Total cost of allocations not matched by any rule.
+	UnmappedCost prometheus.Gauge
+	// Number of allocations not matched by any rule.
+	UnmappedAllocations prometheus.Gauge
+}
+
+// Create new MappingMetrics from configuration.
+func NewMappingMetrics(v *viper.Viper) *MappingMetrics {
+	opts := func(name, help string) prometheus.GaugeOpts {
+		return prometheus.GaugeOpts{
+			Namespace: v.GetString("metrics.namespace"),
+			Subsystem: v.GetString("metrics.subsystem"),
+			Name:      name,
+			Help:      help,
+		}
+	}
+	return &MappingMetrics{
+		config:              v,
+		UnmappedCost:        prometheus.NewGauge(opts("unmapped_total_cost", "Total cost of allocations not matched by any mapping rule.")),
+		UnmappedAllocations: prometheus.NewGauge(opts("unmapped_allocations", "Number of allocations not matched by any mapping rule.")),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *MappingMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.UnmappedCost.Describe(ch)
+	m.UnmappedAllocations.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *MappingMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.UnmappedCost.Collect(ch)
+	m.UnmappedAllocations.Collect(ch)
+}
+
+// Update metrics with the allocations retrieved during the cycle.
+func (m *MappingMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	mapping := getCachedMapping(m.config)
+	if mapping == nil {
+		return nil
+	}
+	var cost float64
+	var n int
+	for _, a := range as {
+		if _, ok := mapping.Labels(a.Properties); !ok {
+			cost += a.TotalCost
+			n++
+		}
+	}
+	m.UnmappedCost.Set(cost)
+	m.UnmappedAllocations.Set(float64(n))
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMappingRules(t *testing.T) {
+	dir := t.TempDir()
+	csvPath, yamlPath := filepath.Join(dir, "mapping.csv"), filepath.Join(dir, "mapping.yaml")
+	assert.NoError(t, os.WriteFile(csvPath, []byte(`type,match,team,cost_center,product
+namespace,payments,payments,CC-100,checkout
+label,app=search,discovery,CC-200,search
+controller,billing-.*,billing,CC-100,
+`), 0o644))
+	assert.NoError(t, os.WriteFile(yamlPath, []byte(`rules:
+  - type: namespace
+    match: payments
+    team: payments
+    cost_center: CC-100
+    product: checkout
+`), 0o644))
+	rules, err := ReadMappingRules(csvPath)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 3)
+	assert.Equal(t, "discovery", rules[1].Team)
+	rules, err = ReadMappingRules(yamlPath)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, "CC-100", rules[0].CostCenter)
+	bad := filepath.Join(dir, "bad.csv")
+	assert.NoError(t, os.WriteFile(bad, []byte("type,match\nlabel,app\n"), 0o644))
+	_, err = ReadMappingRules(bad)
+	assert.ErrorContains(t, err, "Invalid label match 'app'")
+	_, err = ReadMappingRules(filepath.Join(dir, "mapping.json"))
+	assert.ErrorContains(t, err, "Unsupported mapping file extension")
+}
+
+func TestMappingRuleMatches(t *testing.T) {
+	props := map[string]any{
+		"namespace":  "payments",
+		"controller": "billing-api",
+		"labels":     map[string]any{"app": "search"},
+	}
+	cases := []struct {
+		rule map[string]string
+		want bool
+	}{
+		{rule: map[string]string{"type": "namespace", "match": "payments"}, want: true},
+		{rule: map[string]string{"type": "namespace", "match": "pay"}, want: false},
+		{rule: map[string]string{"type": "label", "match": "app=search"}, want: true},
+		{rule: map[string]string{"type": "label", "match": "app=api"}, want: false},
+		{rule: map[string]string{"type": "controller", "match": "billing-.*"}, want: true},
+		{rule: map[string]string{"type": "controller", "match": "billing"}, want: false},
+	}
+	for _, c := range cases {
+		r, err := NewMappingRule(c.rule)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, r.Matches(props), c.rule)
+	}
+}
+
+func TestMappingLabels(t *testing.T) {
+	DisableLogger()
+	defer func() { Now = time.Now }()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return now }
+	path := filepath.Join(t.TempDir(), "mapping.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("type,match,team,cost_center,product\nnamespace,a,x,CC-1,\n"), 0o644))
+	v := NewTestConfig([]byte(`mapping:
+  enabled: true
+  path: ` + path + `
+  reload_interval: 1m
+`))
+	m, err := NewMapping(v)
+	assert.NoError(t, err)
+	ls, ok := m.Labels(map[string]any{"namespace": "a"})
+	assert.True(t, ok)
+	assert.Equal(t, prometheus.Labels{"team": "x", "cost_center": "CC-1", "product": "unmapped"}, ls)
+	ls, ok = m.Labels(map[string]any{"namespace": "b"})
+	assert.False(t, ok)
+	assert.Equal(t, prometheus.Labels{"team": "unmapped", "cost_center": "unmapped", "product": "unmapped"}, ls)
+	// The mapping file is reloaded when it changes.
+	assert.NoError(t, os.WriteFile(path, []byte("type,match,team\nnamespace,b,y\n"), 0o644))
+	assert.NoError(t, os.Chtimes(path, now, now.Add(time.Hour)))
+	_, ok = m.Labels(map[string]any{"namespace": "b"})
+	assert.False(t, ok)
+	now = now.Add(time.Minute)
+	ls, ok = m.Labels(map[string]any{"namespace": "b"})
+	assert.True(t, ok)
+	assert.Equal(t, "y", ls["team"])
+}
+
+func TestMappingMetricsRecord(t *testing.T) {
+	DisableLogger()
+	path := filepath.Join(t.TempDir(), "mapping.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("type,match,team\nnamespace,a,x\n"), 0o644))
+	v := NewTestConfig([]byte(`metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+  labels:
+    - name: namespace
+      key: "namespace"
+mapping:
+  enabled: true
+  path: ` + path + `
+`))
+	assert.Equal(t, []string{"namespace", "team", "cost_center", "product"}, GetPrometheusMetricsLabelNames(v))
+	ls, ok := NewPrometheusLabelsFromAllocation(v, Allocation{Properties: map[string]any{"namespace": "a"}})
+	assert.True(t, ok)
+	assert.Equal(t, prometheus.Labels{"namespace": "a", "team": "x", "cost_center": "unmapped", "product": "unmapped"}, ls)
+	m := NewMappingMetrics(v)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 1},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 2},
+		{Properties: map[string]any{"namespace": "c"}, TotalCost: 3},
+	}))
+	assert.Equal(t, 5.0, testutil.ToFloat64(m.UnmappedCost))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.UnmappedAllocations))
+}
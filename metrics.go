@@ -10,7 +10,13 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
@@ -18,12 +24,40 @@ import (
 // mappings.
 type PrometheusMetrics map[string]*prometheus.GaugeVec
 
+// Describe sends the descriptors of each metric to the provided channel. It
+// implements prometheus.Collector.
+func (metrics PrometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range metrics {
+		m.Describe(ch)
+	}
+}
+
+// Collect sends each metric to the provided channel. It implements
+// prometheus.Collector.
+func (metrics PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range metrics {
+		m.Collect(ch)
+	}
+}
+
 // Create new PrometheusMetrics from configuration.
 func NewPrometheusMetrics(v *viper.Viper) PrometheusMetrics {
+	return NewPrometheusMetricsFromNames(v, GetPrometheusMetricsNames(v), "")
+}
+
+// Create new PrometheusMetrics from a slice of name -> field mappings.
+//
+// Metric names are prefixed with prefix (ex. "projected_"). The namespace,
+// subsystem and labels of each metric are retrieved from configuration.
+func NewPrometheusMetricsFromNames(v *viper.Viper, names []map[string]string, prefix string) PrometheusMetrics {
+	return NewPrometheusMetricsWithLabelNames(v, names, prefix, GetPrometheusMetricsLabelNames(v))
+}
+
+// Create new PrometheusMetrics from a slice of name -> field mappings with the
+// given label names.
+func NewPrometheusMetricsWithLabelNames(v *viper.Viper, names []map[string]string, prefix string, labels []string) PrometheusMetrics {
 	// Create a map (PrometheusMetrics) to associate Allocation field names with
 	// Prometheus metrics.
-	names := GetPrometheusMetricsNames(v)
-	labels := GetPrometheusMetricsLabelNames(v)
 	metrics := make(PrometheusMetrics, len(names))
 	for _, n := range names {
 		// NOTE: Do NOT use promauto.NewGaugeVec. This function automatically
@@ -34,7 +68,7 @@ func NewPrometheusMetrics(v *viper.Viper) PrometheusMetrics {
 			prometheus.GaugeOpts{
 				Namespace: v.GetString("metrics.namespace"),
 				Subsystem: v.GetString("metrics.subsystem"),
-				Name:      n["name"],
+				Name:      prefix + n["name"],
 			}, labels,
 		)
 	}
@@ -42,16 +76,19 @@ func NewPrometheusMetrics(v *viper.Viper) PrometheusMetrics {
 }
 
 // Get Prometheus metric names as slice of mappings.
+func GetPrometheusMetricsNames(v *viper.Viper) []map[string]string {
+	return GetNameFieldMappings(v, "metrics.names")
+}
+
+// Get a list of name -> field mappings at key as slice of mappings.
 //
 // It is not possible to retrieve a slice of map[string]string values (ex.
-// []map[string]string) using Viper's utility functions. Instead, GetStringMap
-// is used to retrieve the value associated with the key as a map of
-// interfaces. A slice of map[string]string elements is constructed by
-// asserting the type of the interface values, which should always be of type
-// map[string]string.
-func GetPrometheusMetricsNames(v *viper.Viper) []map[string]string {
-	metrics := v.GetStringMap("metrics")
-	ns := metrics["names"].([]any)
+// []map[string]string) using Viper's utility functions. Instead, Get is used
+// to retrieve the value associated with the key as a slice of interfaces. A
+// slice of map[string]string elements is constructed by asserting the type of
+// the interface values, which should always be of type map[string]string.
+func GetNameFieldMappings(v *viper.Viper, key string) []map[string]string {
+	ns, _ := v.Get(key).([]any)
 	names := make([]map[string]string, len(ns))
 	for i, n := range ns {
 		names[i] = map[string]string{
@@ -84,13 +121,23 @@ func GetPrometheusMetricsLabels(v *viper.Viper) []map[string]string {
 }
 
 // Get Prometheus metric label names as slice of strings.
+//
+// Label names added by the mapping (see "mapping") and relabel configs (see
+// "metrics.relabel_configs") are appended to the configured label names.
 func GetPrometheusMetricsLabelNames(c *viper.Viper) []string {
 	labels := GetPrometheusMetricsLabels(c)
 	names := make([]string, len(labels))
 	for i, l := range labels {
 		names[i] = l["name"]
 	}
-	return names
+	if c.GetBool("mapping.enabled") {
+		for _, n := range MappingLabelNames {
+			if !contains(names, n) {
+				names = append(names, n)
+			}
+		}
+	}
+	return GetRelabeledLabelNames(names, getCachedRelabelConfigs(c))
 }
 
 // Create new prometheus.Labels from configuration and values.
@@ -123,3 +170,327 @@ func NewPrometheusLabelsFromValues(v *viper.Viper, m map[string]any) prometheus.
 	}
 	return labels
 }
+
+// Create new prometheus.Labels for an allocation.
+//
+// Labels are created from the allocation properties (see
+// NewPrometheusLabelsFromValues), Kubernetes labels and annotations matching
+// "metrics.label_allowlist" (see ExpandKubernetesLabels) and the mapping (see
+// Mapping), then rewritten by relabel configs (see Relabel). Returns false if the allocation
+// is dropped by a relabel config.
+//
+// Labels with an empty value are omitted, so the label names of allocations
+// may differ. See ConformLabels.
+func NewExpandedPrometheusLabelsFromAllocation(v *viper.Viper, a Allocation) (prometheus.Labels, bool) {
+	ls := ExpandKubernetesLabels(a.Properties, getCachedLabelAllowlists(v))
+	// Labels configured in "metrics.labels" take precedence.
+	for k, val := range NewPrometheusLabelsFromValues(v, a.Properties) {
+		ls[k] = val
+	}
+	if m := getCachedMapping(v); m != nil {
+		owner, _ := m.Labels(a.Properties)
+		for k, val := range owner {
+			ls[k] = val
+		}
+	}
+	return Relabel(ls, getCachedRelabelConfigs(v))
+}
+
+// Create new prometheus.Labels for an allocation with the label names
+// returned by GetPrometheusMetricsLabelNames.
+//
+// Labels not configured in "metrics.labels" or added by relabel configs (ex.
+// Kubernetes labels matching "metrics.label_allowlist") are omitted. Returns
+// false if the allocation is dropped by a relabel config.
+func NewPrometheusLabelsFromAllocation(v *viper.Viper, a Allocation) (prometheus.Labels, bool) {
+	ls, ok := NewExpandedPrometheusLabelsFromAllocation(v, a)
+	if !ok {
+		return nil, false
+	}
+	return ConformLabels(ls, GetPrometheusMetricsLabelNames(v)), true
+}
+
+// Conform labels to the given label names.
+//
+// Label cardinality must be consistent when retrieving a Gauge with
+// GetMetricWith, so absent labels are given an empty value and labels not in
+// names are omitted.
+func ConformLabels(ls prometheus.Labels, names []string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(names))
+	for _, n := range names {
+		labels[n] = ls[n]
+	}
+	return labels
+}
+
+// Get a string that uniquely identifies a set of labels.
+//
+// The key is used to group values by label set (ex. to sum the values of
+// allocations whose labels are identical).
+func GetLabelsKey(ls prometheus.Labels) string {
+	ks := make([]string, 0, len(ls))
+	for k := range ls {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	elems := make([]string, len(ks))
+	for i, k := range ks {
+		elems[i] = fmt.Sprintf("%s=%q", k, ls[k])
+	}
+	return strings.Join(elems, ",")
+}
+
+// LabelSetValues holds Allocation field values for a set of labels.
+type LabelSetValues struct {
+	Labels prometheus.Labels
+	// Allocation field name -> value.
+	Values map[string]float64
+	// Total minutes of the allocations, used to weight averages. Only set by
+	// Aggregator.
+	Minutes float64
+}
+
+// Sum the values of the given Allocation fields by label set.
+//
+// Allocations are mapped to labels using NewPrometheusLabelsFromAllocation.
+// Allocations dropped by relabel configs are skipped. The returned map is
+// keyed by GetLabelsKey.
+func SumByLabels(v *viper.Viper, as []Allocation, fields []string) map[string]*LabelSetValues {
+	sums := map[string]*LabelSetValues{}
+	for _, a := range as {
+		ls, ok := NewPrometheusLabelsFromAllocation(v, a)
+		if !ok {
+			continue
+		}
+		k := GetLabelsKey(ls)
+		if _, ok := sums[k]; !ok {
+			sums[k] = &LabelSetValues{Labels: ls, Values: map[string]float64{}}
+		}
+		for _, f := range fields {
+			sums[k].Values[f] += a.GetValueByFieldNameFloat(f)
+		}
+	}
+	return sums
+}
+
+// AllocationMetrics holds the metrics configured in "metrics.names" and,
+// optionally, an info metric (see "metrics.info"). It implements both the
+// Recorder and prometheus.Collector interfaces.
+//
+// Since Kubernetes labels matching "metrics.label_allowlist" become labels,
+// the label names of the metrics may change between updates. When they do,
+// the metrics are recreated. As such, AllocationMetrics is an unchecked
+// collector, that is, its Describe method sends no descriptors.
+type AllocationMetrics struct {
+	config *viper.Viper
+	// Guards Metrics, Info and their label names, which are replaced when the
+	// label names change.
+	mu         sync.RWMutex
+	labels     []string
+	infoLabels []string
+	Metrics    PrometheusMetrics
+	// Info is nil, unless "metrics.info.enabled" is true.
+	Info *prometheus.GaugeVec
+	// Number of series dropped by "max_series" limits, by metric name.
+	Dropped *prometheus.CounterVec
+	// Number of allocations aggregated into the series of another allocation.
+	Collisions prometheus.Counter
+}
+
+// Create new AllocationMetrics from configuration.
+func NewAllocationMetrics(v *viper.Viper) *AllocationMetrics {
+	labels := GetPrometheusMetricsLabelNames(v)
+	if v.GetBool("metrics.info.enabled") {
+		labels = GetInfoIdentityLabelNames(v)
+	}
+	return &AllocationMetrics{
+		config:  v,
+		labels:  labels,
+		Metrics: NewPrometheusMetricsWithLabelNames(v, GetPrometheusMetricsNames(v), "", labels),
+		Dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: v.GetString("metrics.namespace"),
+				Subsystem: v.GetString("metrics.subsystem"),
+				Name:      "dropped_series_total",
+				Help:      "Number of series dropped by series limits.",
+			}, []string{"metric"},
+		),
+		Collisions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: v.GetString("metrics.namespace"),
+				Subsystem: v.GetString("metrics.subsystem"),
+				Name:      "label_set_collisions_total",
+				Help:      "Number of allocations aggregated into the series of another allocation with the same labels.",
+			},
+		),
+	}
+}
+
+// Get the names of the labels identifying an allocation, that is, the labels
+// shared by the info metric and all other metrics.
+//
+// Defaults to the label names returned by GetPrometheusMetricsLabelNames.
+func GetInfoIdentityLabelNames(v *viper.Viper) []string {
+	if names := cast.ToStringSlice(v.Get("metrics.info.identity_labels")); len(names) > 0 {
+		return names
+	}
+	return GetPrometheusMetricsLabelNames(v)
+}
+
+// Describe implements prometheus.Collector. No descriptors are sent, since
+// label names are not known upfront.
+func (m *AllocationMetrics) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (m *AllocationMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.Metrics.Collect(ch)
+	m.Dropped.Collect(ch)
+	m.Collisions.Collect(ch)
+	if m.Info != nil {
+		m.Info.Collect(ch)
+	}
+}
+
+// Get the current label names of the metrics.
+func (m *AllocationMetrics) LabelNames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.labels
+}
+
+// Update metrics with the allocations retrieved during the cycle.
+//
+// The label names of the metrics are the label names returned by
+// GetPrometheusMetricsLabelNames, followed by the sorted label names of any
+// other labels of the allocations (ex. Kubernetes labels matching
+// "metrics.label_allowlist"). Labels absent from an allocation are given an
+// empty value, so that label sets are consistent across all series.
+//
+// If "metrics.info.enabled" is true, the metrics only have the identity labels
+// (see GetInfoIdentityLabelNames), and all labels are moved to the info metric,
+// whose value is always 1. The info metric is reset on each update.
+//
+// Allocations with the same labels are aggregated into a single series using
+// the aggregation function of each metric (see GetAggregations).
+//
+// Series limits (see GetSeriesLimits) are applied to each metric separately.
+// Metrics with a limit are reset on each update.
+func (m *AllocationMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	type series struct {
+		a      Allocation
+		labels prometheus.Labels
+	}
+	ss := []series{}
+	names := GetPrometheusMetricsLabelNames(m.config)
+	seen := map[string]bool{}
+	for _, n := range names {
+		seen[n] = true
+	}
+	others := []string{}
+	for _, a := range as {
+		// Allocation properties are used to set Prometheus metric label values.
+		// Allocations may be dropped by relabel configs.
+		ls, ok := NewExpandedPrometheusLabelsFromAllocation(m.config, a)
+		if !ok {
+			continue
+		}
+		for n := range ls {
+			if !seen[n] {
+				seen[n] = true
+				others = append(others, n)
+			}
+		}
+		ss = append(ss, series{a: a, labels: ls})
+	}
+	sort.Strings(others)
+	names = append(names, others...)
+	info := m.config.GetBool("metrics.info.enabled")
+	var infoNames []string
+	if info {
+		infoNames = GetInfoIdentityLabelNames(m.config)
+		for _, n := range names {
+			if !contains(infoNames, n) {
+				infoNames = append(infoNames, n)
+			}
+		}
+		names = GetInfoIdentityLabelNames(m.config)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.Join(names, ",") != strings.Join(m.labels, ",") {
+		m.labels = names
+		m.Metrics = NewPrometheusMetricsWithLabelNames(m.config, GetPrometheusMetricsNames(m.config), "", names)
+	}
+	if info && (m.Info == nil || strings.Join(infoNames, ",") != strings.Join(m.infoLabels, ",")) {
+		m.infoLabels = infoNames
+		m.Info = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: m.config.GetString("metrics.namespace"),
+				Subsystem: m.config.GetString("metrics.subsystem"),
+				Name:      GetInfoMetricName(m.config),
+				Help:      "Kubernetes labels and annotations of each allocation.",
+			}, infoNames,
+		)
+	}
+	if m.Info != nil {
+		m.Info.Reset()
+	}
+	// Allocations whose labels are identical are mapped to the same series.
+	// Their values are aggregated (see GetAggregations).
+	limits := GetSeriesLimits(m.config)
+	fields := []string{}
+	for field, l := range limits {
+		for _, f := range []string{field, l.By} {
+			if !contains(fields, f) {
+				fields = append(fields, f)
+			}
+		}
+	}
+	g := NewAggregator(GetAggregations(m.config), fields)
+	for _, s := range ss {
+		g.Add(ConformLabels(s.labels, names), s.a)
+		if info {
+			m.Info.With(ConformLabels(s.labels, infoNames)).Set(1)
+		}
+	}
+	if g.Collisions > 0 {
+		logger.Printf("%d allocations have the same labels as another allocation. Their values are aggregated\n", g.Collisions)
+		m.Collisions.Add(float64(g.Collisions))
+	}
+	sets := g.Sets()
+	for _, n := range GetPrometheusMetricsNames(m.config) {
+		// 'field' is the Allocation struct field name for the corresponding
+		// Prometheus metric.
+		field, metric := n["field"], m.Metrics[n["field"]]
+		l := limits[field]
+		if l.Enabled() {
+			// Remove label sets which are no longer in the top N.
+			metric.Reset()
+		}
+		limited, dropped := LimitSeries(sets, field, g.fn(field), l)
+		if dropped > 0 {
+			m.Dropped.WithLabelValues(n["name"]).Add(float64(dropped))
+		}
+		for _, set := range limited {
+			g, err := metric.GetMetricWith(set.Labels)
+			if err != nil {
+				logger.Printf(
+					"Number of label values is not the same as the number of "+
+						"variable labels in Desc: %s\n", err)
+				continue
+			}
+			g.Set(set.Values[field])
+		}
+	}
+	return nil
+}
+
+// Get the name of the info metric. Defaults to "allocation_info".
+func GetInfoMetricName(v *viper.Viper) string {
+	if name := v.GetString("metrics.info.name"); name != "" {
+		return name
+	}
+	return "allocation_info"
+}
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -261,3 +262,170 @@ func TestNewPrometheusLabelsFromValues(t *testing.T) {
 		})
 	}
 }
+
+func TestNewPrometheusLabelsFromAllocation(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  names: []
+  labels:
+    - name: namespace
+      key: "namespace"
+    - name: controller
+      key: "controller"
+  relabel_configs:
+    - source_labels: [controller]
+      regex: "prefix-(.*)"
+      target_label: workload
+    - source_labels: [namespace]
+      regex: "kube-system"
+      action: drop
+`))
+	assert.Equal(t, []string{"namespace", "controller", "workload"}, GetPrometheusMetricsLabelNames(v))
+	cases := []struct {
+		a        Allocation
+		want     prometheus.Labels
+		wantKeep bool
+	}{
+		{
+			a: Allocation{Properties: map[string]any{"namespace": "a", "controller": "prefix-api"}},
+			want: prometheus.Labels{
+				"namespace":  "a",
+				"controller": "prefix-api",
+				"workload":   "api",
+			},
+			wantKeep: true,
+		},
+		// Labels absent after relabeling are given an empty value.
+		{
+			a: Allocation{Properties: map[string]any{"namespace": "a"}},
+			want: prometheus.Labels{
+				"namespace":  "a",
+				"controller": "",
+				"workload":   "",
+			},
+			wantKeep: true,
+		},
+		{
+			a:        Allocation{Properties: map[string]any{"namespace": "kube-system"}},
+			want:     nil,
+			wantKeep: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			ret, keep := NewPrometheusLabelsFromAllocation(v, tc.a)
+			assert.Equal(t, tc.wantKeep, keep)
+			assert.Equal(t, tc.want, ret)
+		})
+	}
+}
+
+func TestGetLabelsKey(t *testing.T) {
+	a := GetLabelsKey(prometheus.Labels{"a": "1", "b": "2"})
+	b := GetLabelsKey(prometheus.Labels{"b": "2", "a": "1"})
+	c := GetLabelsKey(prometheus.Labels{"a": "1,b=2"})
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
+
+func TestSumByLabels(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  names: []
+  labels:
+    - name: namespace
+      key: "namespace"
+`))
+	as := []Allocation{
+		{Properties: map[string]any{"namespace": "a", "pod": "1"}, CPUCost: 1, TotalCost: 2},
+		{Properties: map[string]any{"namespace": "a", "pod": "2"}, CPUCost: 3, TotalCost: 4},
+		{Properties: map[string]any{"namespace": "b", "pod": "3"}, CPUCost: 5, TotalCost: 6},
+	}
+	ret := SumByLabels(v, as, []string{"CPUCost", "TotalCost"})
+	assert.Equal(t, map[string]*LabelSetValues{
+		GetLabelsKey(prometheus.Labels{"namespace": "a"}): {
+			Labels: prometheus.Labels{"namespace": "a"},
+			Values: map[string]float64{"CPUCost": 4, "TotalCost": 6},
+		},
+		GetLabelsKey(prometheus.Labels{"namespace": "b"}): {
+			Labels: prometheus.Labels{"namespace": "b"},
+			Values: map[string]float64{"CPUCost": 5, "TotalCost": 6},
+		},
+	}, ret)
+}
+
+func TestAllocationMetricsRecord(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  names:
+    - name: total_cost
+      field: TotalCost
+  labels:
+    - name: namespace
+      key: "namespace"
+  label_allowlist:
+    labels: ["app", "team"]
+`))
+	m := NewAllocationMetrics(v)
+	r := prometheus.NewPedanticRegistry()
+	r.MustRegister(m)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"namespace": "a", "labels": map[string]any{"app": "api"}}, TotalCost: 1},
+		{Properties: map[string]any{"namespace": "b", "labels": map[string]any{"team": "x"}}, TotalCost: 2},
+		{Properties: map[string]any{"namespace": "c"}, TotalCost: 3},
+	}))
+	assert.Equal(t, []string{"namespace", "label_app", "label_team"}, m.LabelNames())
+	_, err := r.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, testutil.CollectAndCount(m.Metrics))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("a", "api", "")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("b", "", "x")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("c", "", "")))
+	// Metrics are recreated when label names change.
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"namespace": "a", "labels": map[string]any{"app": "api"}}, TotalCost: 4},
+	}))
+	assert.Equal(t, []string{"namespace", "label_app"}, m.LabelNames())
+	_, err = r.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(m.Metrics))
+	assert.Equal(t, 4.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("a", "api")))
+}
+
+func TestAllocationMetricsRecordInfo(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  names:
+    - name: total_cost
+      field: TotalCost
+  labels:
+    - name: pod
+      key: "pod"
+    - name: namespace
+      key: "namespace"
+  info:
+    enabled: true
+`))
+	m := NewAllocationMetrics(v)
+	r := prometheus.NewPedanticRegistry()
+	r.MustRegister(m)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"pod": "a", "namespace": "x", "labels": map[string]any{"app": "api"}}, TotalCost: 1},
+		{Properties: map[string]any{"pod": "b", "namespace": "x", "annotations": map[string]any{"owner": "me"}}, TotalCost: 2},
+	}))
+	// Cost metrics only carry identity labels.
+	assert.Equal(t, []string{"pod", "namespace"}, m.LabelNames())
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("a", "x")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Metrics["TotalCost"].WithLabelValues("b", "x")))
+	// The info metric carries all labels.
+	assert.Equal(t, 2, testutil.CollectAndCount(m.Info))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Info.WithLabelValues("a", "x", "", "api")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.Info.WithLabelValues("b", "x", "me", "")))
+	mfs, err := r.Gather()
+	assert.NoError(t, err)
+	names := []string{}
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	assert.ElementsMatch(t, []string{"kubecost_allocation_info", "kubecost_label_set_collisions_total", "kubecost_total_cost"}, names)
+}
@@ -0,0 +1,378 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Webhook notifications on cost thresholds.
+//
+// After each cycle, the cost of each group of allocations (ex. namespace) is
+// evaluated against the configured rules. A notification is sent when the cost
+// exceeds a threshold or increases by more than a percentage versus the
+// previous cycle.
+//
+// Notifications are rendered using Go templates (see text/template) and POSTed
+// as JSON to the configured webhook URLs.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Notification kinds.
+const (
+	NotificationKindThreshold = "threshold"
+	NotificationKindChange    = "change"
+)
+
+// Default webhook payload templates by format.
+var DefaultNotificationTemplates = map[string]string{
+	// See: https://api.slack.com/messaging/webhooks
+	"slack": `{"text": {{ json .Message }}}`,
+	"generic": `{` +
+		`"rule": {{ json .Rule }}, ` +
+		`"kind": {{ json .Kind }}, ` +
+		`"key": {{ json .Key }}, ` +
+		`"value": {{ json .Value }}, ` +
+		`"window": {{ json .Window }}, ` +
+		`"cost": {{ json .Cost }}, ` +
+		`"previous_cost": {{ json .Previous }}, ` +
+		`"threshold": {{ json .Threshold }}, ` +
+		`"change_percent": {{ json .ChangePercent }}, ` +
+		`"time": {{ json .Time }}, ` +
+		`"message": {{ json .Message }}` +
+		`}`,
+}
+
+// ErrFailedWebhookCall is returned when an error or bad response is returned
+// from a webhook URL.
+var ErrFailedWebhookCall = errors.New("Failed to send notification to webhook")
+
+// A Notification is sent when the cost of a group of allocations crosses a
+// threshold or increases by more than a percentage versus the previous cycle.
+type Notification struct {
+	Rule  string
+	Kind  string
+	Key   string
+	Value string
+	// Window over which cost is evaluated. Empty if evaluated over the window
+	// configured in "api.parameters.window".
+	Window        string
+	Cost          float64
+	Previous      float64
+	Threshold     float64
+	ChangePercent float64
+	Time          time.Time
+}
+
+// Human-readable notification message.
+func (n Notification) Message() string {
+	window := n.Window
+	if window == "" {
+		window = "current window"
+	}
+	switch n.Kind {
+	case NotificationKindChange:
+		return fmt.Sprintf("[%s] Cost of %s '%s' over %s increased from %.2f to %.2f (more than %g%%)",
+			n.Rule, n.Key, n.Value, window, n.Previous, n.Cost, n.ChangePercent)
+	default:
+		return fmt.Sprintf("[%s] Cost of %s '%s' over %s is %.2f, exceeding threshold of %.2f",
+			n.Rule, n.Key, n.Value, window, n.Cost, n.Threshold)
+	}
+}
+
+// A NotificationRule groups allocations by key and evaluates the total cost of
+// each group.
+type NotificationRule struct {
+	Name string
+	// Dot-separated key in the Allocation API response properties.
+	Key string
+	// If not empty, cost is evaluated over this window (ex. 1d) instead of the
+	// window configured in "api.parameters.window".
+	Window string
+	// Notify when cost exceeds the threshold. Ignored if 0.
+	Threshold float64
+	// Notify when cost increases by more than the percentage versus the
+	// previous cycle. Ignored if 0.
+	ChangePercent float64
+	// Names of webhooks to notify. If empty, all webhooks are notified.
+	Webhooks []string
+}
+
+// A Webhook is a URL that notifications are POSTed to.
+type Webhook struct {
+	Name     string
+	URL      string
+	Template *template.Template
+}
+
+// Get notification rules from configuration.
+func GetNotificationRules(v *viper.Viper) []NotificationRule {
+	items, _ := v.Get("notifications.rules").([]any)
+	rules := make([]NotificationRule, len(items))
+	for i, item := range items {
+		m := item.(map[string]any)
+		rules[i] = NotificationRule{
+			Name:          GetElementOrZeroValue[string]("name", m),
+			Key:           GetElementOrZeroValue[string]("key", m),
+			Window:        GetElementOrZeroValue[string]("window", m),
+			Threshold:     cast.ToFloat64(m["threshold"]),
+			ChangePercent: cast.ToFloat64(m["change_percent"]),
+			Webhooks:      cast.ToStringSlice(m["webhooks"]),
+		}
+		if rules[i].Key == "" {
+			rules[i].Key = "namespace"
+		}
+	}
+	return rules
+}
+
+// Get webhooks from configuration.
+//
+// Each webhook uses either a custom template or the default template of its
+// format ("slack" or "generic").
+func GetWebhooks(v *viper.Viper) ([]Webhook, error) {
+	items, _ := v.Get("notifications.webhooks").([]any)
+	webhooks := make([]Webhook, len(items))
+	for i, item := range items {
+		m := item.(map[string]any)
+		name, format := GetElementOrZeroValue[string]("name", m), GetElementOrZeroValue[string]("format", m)
+		text := GetElementOrZeroValue[string]("template", m)
+		if text == "" {
+			if format == "" {
+				format = "generic"
+			}
+			var ok bool
+			if text, ok = DefaultNotificationTemplates[format]; !ok {
+				return nil, fmt.Errorf("Unknown format '%s' for webhook '%s'", format, name)
+			}
+		}
+		tmpl, err := template.New(name).Funcs(template.FuncMap{
+			"json": func(v any) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse template for webhook '%s': %w", name, err)
+		}
+		webhooks[i] = Webhook{
+			Name:     name,
+			URL:      GetElementOrZeroValue[string]("url", m),
+			Template: tmpl,
+		}
+	}
+	return webhooks, nil
+}
+
+// Notifier evaluates notification rules and sends notifications to webhooks.
+// It implements the Recorder interface.
+type Notifier struct {
+	config   *viper.Viper
+	client   *http.Client
+	rules    []NotificationRule
+	webhooks []Webhook
+	renotify time.Duration
+	// Cost of each group during the previous cycle, keyed by rule and group.
+	previous map[notificationKey]float64
+	// Time of the last notification, keyed by rule, group, kind and webhook.
+	sent map[notificationKey]time.Time
+}
+
+// A notificationKey identifies a group of a rule and, optionally, a kind of
+// notification and the webhook it was sent to.
+type notificationKey struct {
+	rule, value, kind, webhook string
+}
+
+// Create new Notifier from configuration.
+func NewNotifier(v *viper.Viper) (*Notifier, error) {
+	webhooks, err := GetWebhooks(v)
+	if err != nil {
+		return nil, err
+	}
+	renotify, err := ParseDuration(v.GetString("notifications.renotify_interval"))
+	if err != nil {
+		logger.Printf("Error parsing 'notifications.renotify_interval' config: %v. Defaulting to 4h", err)
+		renotify = 4 * time.Hour
+	}
+	timeout, err := ParseDuration(v.GetString("notifications.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'notifications.timeout' config: %v. Defaulting to 10s", err)
+		timeout = 10 * time.Second
+	}
+	return &Notifier{
+		config:   v,
+		client:   &http.Client{Timeout: timeout},
+		rules:    GetNotificationRules(v),
+		webhooks: webhooks,
+		renotify: renotify,
+		previous: map[notificationKey]float64{},
+		sent:     map[notificationKey]time.Time{},
+	}, nil
+}
+
+// Evaluate notification rules and send notifications.
+func (n *Notifier) Record(c AllocationAPI, as []Allocation) error {
+	now := Now()
+	errs := []error{}
+	for _, rule := range n.rules {
+		ras := as
+		if rule.Window != "" {
+			dur, err := ParseDuration(rule.Window)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Error parsing window of rule '%s': %w", rule.Name, err))
+				continue
+			}
+			end := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location())
+			ras, err = GetAllocationForWindow(c, n.config, QueryNotifications, end.Add(-dur), end)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		for _, notification := range n.Evaluate(rule, GroupTotalCost(rule.Key, ras), now) {
+			for _, w := range n.ruleWebhooks(rule) {
+				// Notifications are only sent to webhooks which are due, so
+				// that notifications which failed to be sent to a webhook are
+				// retried next cycle without repeating them to other webhooks.
+				if !n.due(notificationKey{rule: rule.Name, value: notification.Value, kind: notification.Kind, webhook: w.Name}, now) {
+					continue
+				}
+				if err := n.Send(w, notification); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				n.MarkSent(notification, w.Name)
+			}
+		}
+	}
+	return JoinErrors(errs)
+}
+
+// Evaluate a rule against the cost of each group.
+//
+// A notification is not repeated for the same rule, group and kind until
+// "notifications.renotify_interval" has elapsed since it was sent to each of
+// the rule's webhooks (see MarkSent). Once the condition no longer holds, the
+// next crossing is notified immediately. Groups which are no longer present
+// are forgotten.
+func (n *Notifier) Evaluate(rule NotificationRule, costs map[string]float64, now time.Time) []Notification {
+	for k := range n.previous {
+		if _, ok := costs[k.value]; k.rule == rule.Name && !ok {
+			delete(n.previous, k)
+		}
+	}
+	for k := range n.sent {
+		if _, ok := costs[k.value]; k.rule == rule.Name && !ok {
+			delete(n.sent, k)
+		}
+	}
+	notifications := []Notification{}
+	for value, cost := range costs {
+		k := notificationKey{rule: rule.Name, value: value}
+		previous, seen := n.previous[k]
+		n.previous[k] = cost
+		conditions := map[string]bool{
+			NotificationKindThreshold: rule.Threshold > 0 && cost > rule.Threshold,
+			NotificationKindChange: rule.ChangePercent > 0 && seen && previous > 0 &&
+				(cost-previous)/previous*100 > rule.ChangePercent,
+		}
+		for kind, ok := range conditions {
+			due := false
+			for _, w := range n.ruleWebhooks(rule) {
+				sk := notificationKey{rule: rule.Name, value: value, kind: kind, webhook: w.Name}
+				if !ok {
+					delete(n.sent, sk)
+				}
+				due = due || n.due(sk, now)
+			}
+			if !ok || !due {
+				continue
+			}
+			notifications = append(notifications, Notification{
+				Rule:          rule.Name,
+				Kind:          kind,
+				Key:           rule.Key,
+				Value:         value,
+				Window:        rule.Window,
+				Cost:          cost,
+				Previous:      previous,
+				Threshold:     rule.Threshold,
+				ChangePercent: rule.ChangePercent,
+				Time:          now,
+			})
+		}
+	}
+	return notifications
+}
+
+// Render the notification using the webhook's template and POST it to the
+// webhook URL.
+func (n *Notifier) Send(w Webhook, notification Notification) error {
+	var body bytes.Buffer
+	if err := w.Template.Execute(&body, notification); err != nil {
+		return fmt.Errorf("%w '%s': unable to render template: %v", ErrFailedWebhookCall, w.Name, err)
+	}
+	resp, err := n.client.Post(w.URL, "application/json", &body)
+	if err != nil {
+		return fmt.Errorf("%w '%s': %v", ErrFailedWebhookCall, w.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(
+			"%w '%s': unexpected status code: %d", ErrFailedWebhookCall, w.Name, resp.StatusCode)
+	}
+	return nil
+}
+
+// Record that a notification was sent to a webhook, so that it is not repeated
+// to the webhook until "notifications.renotify_interval" has elapsed.
+func (n *Notifier) MarkSent(notification Notification, webhook string) {
+	n.sent[notificationKey{rule: notification.Rule, value: notification.Value, kind: notification.Kind, webhook: webhook}] = notification.Time
+}
+
+// Whether a notification is due: it was never sent, or
+// "notifications.renotify_interval" has elapsed since it was sent.
+func (n *Notifier) due(k notificationKey, now time.Time) bool {
+	last, ok := n.sent[k]
+	return !ok || now.Sub(last) >= n.renotify
+}
+
+// Get the webhooks of a rule. If the rule names no webhooks, all webhooks are
+// notified.
+func (n *Notifier) ruleWebhooks(rule NotificationRule) []Webhook {
+	if len(rule.Webhooks) == 0 {
+		return n.webhooks
+	}
+	webhooks := []Webhook{}
+	for _, w := range n.webhooks {
+		if contains(rule.Webhooks, w.Name) {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks
+}
+
+// Sum TotalCost of allocations grouped by the value of a dot-separated key in
+// the Allocation API response properties.
+//
+// Allocations without a string value for the key are skipped.
+func GroupTotalCost(key string, as []Allocation) map[string]float64 {
+	costs := map[string]float64{}
+	for _, a := range as {
+		v, ok := GetElementFromKey(key, a.Properties).(string)
+		if !ok {
+			continue
+		}
+		costs[v] += a.TotalCost
+	}
+	return costs
+}
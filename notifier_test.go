@@ -0,0 +1,293 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNotificationRules(t *testing.T) {
+	v := NewTestConfig([]byte(`notifications:
+  rules:
+    - name: a
+      window: 1d
+      threshold: 100
+      change_percent: 50.5
+      webhooks: ["slack"]
+    - name: b
+      key: labels.team
+`))
+	assert.Equal(t, []NotificationRule{
+		{Name: "a", Key: "namespace", Window: "1d", Threshold: 100, ChangePercent: 50.5, Webhooks: []string{"slack"}},
+		{Name: "b", Key: "labels.team"},
+	}, GetNotificationRules(v))
+}
+
+func TestGetWebhooks(t *testing.T) {
+	cases := []struct {
+		config  []byte
+		wantErr string
+	}{
+		{
+			config: []byte(`notifications:
+  webhooks:
+    - name: a
+      url: http://localhost
+      format: slack
+    - name: b
+      url: http://localhost
+    - name: c
+      url: http://localhost
+      template: '{"cost": {{ .Cost }}}'
+`),
+		},
+		{
+			config: []byte(`notifications:
+  webhooks:
+    - name: a
+      format: teams
+`),
+			wantErr: "Unknown format 'teams' for webhook 'a'",
+		},
+		{
+			config: []byte(`notifications:
+  webhooks:
+    - name: a
+      template: '{{ .Cost'
+`),
+			wantErr: "Unable to parse template for webhook 'a'",
+		},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			_, err := GetWebhooks(NewTestConfig(tc.config))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestNotifierEvaluate(t *testing.T) {
+	DisableLogger()
+	n, err := NewNotifier(NewTestConfig([]byte(`notifications:
+  renotify_interval: 1h
+  webhooks:
+    - name: a
+      url: http://localhost
+`)))
+	assert.NoError(t, err)
+	rule := NotificationRule{Name: "r", Key: "namespace", Threshold: 10, ChangePercent: 50}
+	t0 := time.Unix(0, 0)
+	kinds := func(ns []Notification) map[string]string {
+		m := map[string]string{}
+		for _, notification := range ns {
+			m[notification.Value] = notification.Kind
+			n.MarkSent(notification, "a")
+		}
+		return m
+	}
+	// No previous cycle, so only thresholds are evaluated.
+	ret := n.Evaluate(rule, map[string]float64{"a": 11, "b": 4}, t0)
+	assert.Equal(t, map[string]string{"a": NotificationKindThreshold}, kinds(ret))
+	// "a" is deduplicated. "b" increased by 100%.
+	ret = n.Evaluate(rule, map[string]float64{"a": 12, "b": 8}, t0.Add(time.Minute))
+	assert.Equal(t, map[string]string{"b": NotificationKindChange}, kinds(ret))
+	assert.Equal(t, 4.0, ret[0].Previous)
+	// "a" is renotified once the renotify interval has elapsed.
+	ret = n.Evaluate(rule, map[string]float64{"a": 12, "b": 8}, t0.Add(time.Hour))
+	assert.Equal(t, map[string]string{"a": NotificationKindThreshold}, kinds(ret))
+	// "a" drops below the threshold, then crosses it again.
+	ret = n.Evaluate(rule, map[string]float64{"a": 5}, t0.Add(61*time.Minute))
+	assert.Empty(t, ret)
+	ret = n.Evaluate(rule, map[string]float64{"a": 7}, t0.Add(62*time.Minute))
+	assert.Empty(t, ret)
+	ret = n.Evaluate(rule, map[string]float64{"a": 10.5}, t0.Add(63*time.Minute))
+	assert.Equal(t, map[string]string{"a": NotificationKindThreshold}, kinds(ret))
+	// Notifications which are not marked as sent are repeated.
+	ret = n.Evaluate(rule, map[string]float64{"c": 11}, t0.Add(64*time.Minute))
+	assert.Len(t, ret, 1)
+	ret = n.Evaluate(rule, map[string]float64{"c": 11}, t0.Add(65*time.Minute))
+	assert.Len(t, ret, 1)
+	// Groups which are no longer present are forgotten.
+	assert.Len(t, n.previous, 1)
+	assert.Empty(t, n.sent)
+}
+
+func TestNotifierRecord(t *testing.T) {
+	DisableLogger()
+	Now = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "1970-01-02T00:00:30Z")
+		return t
+	}
+	defer func() { Now = time.Now }()
+	bodies := map[string][]map[string]any{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			t.Errorf("Expected request method 'POST', got: %s", req.Method)
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected Content-Type 'application/json', got: %s", ct)
+		}
+		b, _ := io.ReadAll(req.Body)
+		var body map[string]any
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("Expected JSON body, got: %s", b)
+		}
+		bodies[req.URL.Path] = append(bodies[req.URL.Path], body)
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	v := NewTestConfig([]byte(`api:
+  host: localhost
+  port: 9003
+  path: /allocation/compute
+  parameters:
+    window: 1m
+    aggregate: pod
+notifications:
+  webhooks:
+    - name: slack
+      url: ` + ts.URL + `/slack
+      format: slack
+    - name: generic
+      url: ` + ts.URL + `/generic
+  rules:
+    - name: current
+      threshold: 1
+      webhooks: ["generic"]
+    - name: daily
+      window: 1d
+      threshold: 10
+`))
+	ctrl := gomock.NewController(t)
+	c := NewMockAllocationAPI(ctrl)
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1970-01-01T00:00:00Z,1970-01-02T00:00:00Z",
+		"aggregate": "pod",
+	}).Return("daily")
+	c.EXPECT().GetAllocation("daily").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 6},
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 6},
+	}, nil)
+	n, err := NewNotifier(v)
+	assert.NoError(t, err)
+	err = n.Record(c, []Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 0.5},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 2},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{
+		"text": "[daily] Cost of namespace 'a' over 1d is 12.00, exceeding threshold of 10.00",
+	}}, bodies["/slack"])
+	assert.Len(t, bodies["/generic"], 2)
+	for _, body := range bodies["/generic"] {
+		switch body["rule"] {
+		case "current":
+			assert.Equal(t, "b", body["value"])
+			assert.Equal(t, 2.0, body["cost"])
+		case "daily":
+			assert.Equal(t, "a", body["value"])
+			assert.Equal(t, "1d", body["window"])
+			assert.Equal(t, 12.0, body["cost"])
+		}
+	}
+}
+
+func TestNotifierSend(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	v := NewTestConfig([]byte(`notifications:
+  webhooks:
+    - name: a
+      url: ` + ts.URL + `
+`))
+	n, err := NewNotifier(v)
+	assert.NoError(t, err)
+	err = n.Send(n.webhooks[0], Notification{})
+	assert.ErrorIs(t, err, ErrFailedWebhookCall)
+	assert.ErrorContains(t, err, "unexpected status code: 500")
+}
+
+func TestNotifierRecordRetry(t *testing.T) {
+	DisableLogger()
+	Now = func() time.Time { return time.Unix(0, 0) }
+	defer func() { Now = time.Now }()
+	status := http.StatusInternalServerError
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	n, err := NewNotifier(NewTestConfig([]byte(`notifications:
+  renotify_interval: 1h
+  webhooks:
+    - name: a
+      url: ` + ts.URL + `
+  rules:
+    - name: r
+      threshold: 1
+`)))
+	assert.NoError(t, err)
+	as := []Allocation{{Properties: map[string]any{"namespace": "a"}, TotalCost: 2}}
+	// A notification which fails to be sent is retried next cycle, and is not
+	// repeated once sent.
+	assert.ErrorIs(t, n.Record(nil, as), ErrFailedWebhookCall)
+	status = http.StatusOK
+	assert.NoError(t, n.Record(nil, as))
+	assert.NoError(t, n.Record(nil, as))
+	assert.Equal(t, 2, calls)
+}
+
+func TestNotifierRecordPartialFailure(t *testing.T) {
+	DisableLogger()
+	Now = func() time.Time { return time.Unix(0, 0) }
+	defer func() { Now = time.Now }()
+	failing := true
+	calls := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls[req.URL.Path]++
+		if req.URL.Path == "/b" && failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	n, err := NewNotifier(NewTestConfig([]byte(`notifications:
+  renotify_interval: 1h
+  webhooks:
+    - name: a
+      url: ` + ts.URL + `/a
+    - name: b
+      url: ` + ts.URL + `/b
+  rules:
+    - name: r
+      threshold: 1
+`)))
+	assert.NoError(t, err)
+	as := []Allocation{{Properties: map[string]any{"namespace": "a"}, TotalCost: 2}}
+	// Only the webhook which failed is retried.
+	assert.ErrorIs(t, n.Record(nil, as), ErrFailedWebhookCall)
+	assert.ErrorIs(t, n.Record(nil, as), ErrFailedWebhookCall)
+	assert.Equal(t, map[string]int{"/a": 1, "/b": 2}, calls)
+	failing = false
+	assert.NoError(t, n.Record(nil, as))
+	assert.NoError(t, n.Record(nil, as))
+	assert.Equal(t, map[string]int{"/a": 1, "/b": 3}, calls)
+}
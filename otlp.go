@@ -0,0 +1,284 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// OpenTelemetry (OTLP/HTTP) sink.
+//
+// After each cycle, the registry is gathered and its samples are pushed to an
+// OTLP/HTTP endpoint (ex. an OpenTelemetry collector) using the JSON
+// encoding. Gauges are converted to OTLP gauges, and counters to cumulative,
+// monotonic OTLP sums. Samples whose value is NaN or infinite are skipped, since
+// they cannot be encoded as JSON numbers.
+//
+// For documentation on OTLP, see the following:
+//   - https://opentelemetry.io/docs/specs/otlp/#otlphttp
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+// ErrFailedOTLPExport is returned when an error or bad response is returned by
+// the OTLP endpoint.
+var ErrFailedOTLPExport = errors.New("Failed to export metrics to OTLP endpoint")
+
+// Name of the instrumentation scope and default service name.
+const OTLPScopeName = "k8s-kubecost-exporter"
+
+// Resource attribute of the cluster name.
+const OTLPClusterAttribute = "k8s.cluster.name"
+
+// Cumulative aggregation temporality of OTLP sums.
+const otlpAggregationTemporalityCumulative = 2
+
+// OTLP JSON types. Only the fields used by the exporter are defined.
+type (
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsDouble          float64        `json:"asDouble"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpMetric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description,omitempty"`
+		Gauge       *otlpGauge `json:"gauge,omitempty"`
+		Sum         *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpScopeMetrics struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpExportMetricsServiceRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+)
+
+// Create OTLP attributes from a map, sorted by key. Attributes with an empty
+// value are omitted.
+func newOTLPAttributes(m map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		kvs[i] = otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: m[k]}}
+	}
+	return kvs
+}
+
+// Create an OTLP ExportMetricsServiceRequest from samples.
+//
+// Samples are grouped into metrics by name, in order of first appearance.
+// Counters are cumulative since start. Non-finite samples are skipped.
+func NewOTLPRequest(samples []Sample, resource map[string]string, start, ts time.Time) any {
+	metrics := []otlpMetric{}
+	index := map[string]int{}
+	for _, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		i, ok := index[s.Name]
+		if !ok {
+			i = len(metrics)
+			index[s.Name] = i
+			m := otlpMetric{Name: s.Name, Description: s.Help}
+			if s.Type == dto.MetricType_COUNTER {
+				m.Sum = &otlpSum{AggregationTemporality: otlpAggregationTemporalityCumulative, IsMonotonic: true}
+			} else {
+				m.Gauge = &otlpGauge{}
+			}
+			metrics = append(metrics, m)
+		}
+		dp := otlpDataPoint{
+			Attributes:   newOTLPAttributes(s.Labels),
+			TimeUnixNano: strconv.FormatInt(ts.UnixNano(), 10),
+			AsDouble:     s.Value,
+		}
+		if m := &metrics[i]; m.Sum != nil {
+			dp.StartTimeUnixNano = strconv.FormatInt(start.UnixNano(), 10)
+			m.Sum.DataPoints = append(m.Sum.DataPoints, dp)
+		} else {
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, dp)
+		}
+	}
+	rm := otlpResourceMetrics{}
+	rm.Resource.Attributes = newOTLPAttributes(resource)
+	sm := otlpScopeMetrics{Metrics: metrics}
+	sm.Scope.Name = OTLPScopeName
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+	return otlpExportMetricsServiceRequest{ResourceMetrics: []otlpResourceMetrics{rm}}
+}
+
+// OTLPExporter pushes gathered samples to an OTLP/HTTP endpoint. It implements
+// the Recorder interface.
+type OTLPExporter struct {
+	config   *viper.Viper
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	url      string
+	headers  map[string]string
+	gzip     bool
+	resource map[string]string
+	// Whether a "cluster" label is configured (see Resource).
+	clusterLabel bool
+	start        time.Time
+}
+
+// Create a new OTLPExporter from configuration. Samples are gathered from g.
+//
+// The resource attributes "service.name" and "service.instance.id" default to
+// "k8s-kubecost-exporter" and the hostname, respectively. "k8s.cluster.name"
+// defaults to "otlp.cluster" (see also Resource).
+func NewOTLPExporter(v *viper.Viper, g prometheus.Gatherer) (*OTLPExporter, error) {
+	endpoint := v.GetString("otlp.endpoint")
+	if endpoint == "" {
+		return nil, errors.New("'otlp.endpoint' is required")
+	}
+	timeout, err := ParseDuration(v.GetString("otlp.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'otlp.timeout' config: %v. Defaulting to 10s", err)
+		timeout = 10 * time.Second
+	}
+	resource := map[string]string{"service.name": OTLPScopeName}
+	if hostname, err := os.Hostname(); err == nil {
+		resource["service.instance.id"] = hostname
+	}
+	if cluster := v.GetString("otlp.cluster"); cluster != "" {
+		resource[OTLPClusterAttribute] = cluster
+	}
+	// Attributes are a list of key-value pairs, rather than a map, since keys
+	// usually contain dots (ex. k8s.cluster.name), which Viper uses as a key
+	// delimiter.
+	attrs, _ := v.Get("otlp.resource_attributes").([]any)
+	for _, attr := range attrs {
+		m := attr.(map[string]any)
+		resource[GetElementOrZeroValue[string]("key", m)] = GetElementOrZeroValue[string]("value", m)
+	}
+	labels, _ := v.Get("metrics.labels").([]any)
+	return &OTLPExporter{
+		config:       v,
+		gatherer:     g,
+		client:       &http.Client{Timeout: timeout},
+		url:          strings.TrimSuffix(endpoint, "/") + "/v1/metrics",
+		headers:      v.GetStringMapString("otlp.headers"),
+		gzip:         v.GetString("otlp.compression") == "gzip",
+		resource:     resource,
+		clusterLabel: len(labels) > 0 && contains(GetPrometheusMetricsLabelNames(v), "cluster"),
+		start:        Now(),
+	}, nil
+}
+
+// Get the resource attributes of the allocations.
+//
+// If "k8s.cluster.name" is not configured, it is the value of the "cluster"
+// label of the allocations, provided that they all share the same value.
+func (e *OTLPExporter) Resource(as []Allocation) map[string]string {
+	if _, ok := e.resource[OTLPClusterAttribute]; ok || !e.clusterLabel {
+		return e.resource
+	}
+	var cluster string
+	for _, a := range as {
+		ls, ok := NewPrometheusLabelsFromAllocation(e.config, a)
+		if !ok || ls["cluster"] == "" {
+			continue
+		}
+		if cluster != "" && ls["cluster"] != cluster {
+			return e.resource
+		}
+		cluster = ls["cluster"]
+	}
+	if cluster == "" {
+		return e.resource
+	}
+	resource := make(map[string]string, len(e.resource)+1)
+	for k, v := range e.resource {
+		resource[k] = v
+	}
+	resource[OTLPClusterAttribute] = cluster
+	return resource
+}
+
+// Gather samples and push them to the OTLP endpoint. Samples are timestamped
+// with the end of the window of the allocations.
+func (e *OTLPExporter) Record(_ AllocationAPI, as []Allocation) error {
+	samples, err := GatherSamples(e.gatherer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedOTLPExport, err)
+	}
+	body, err := json.Marshal(NewOTLPRequest(samples, e.Resource(as), e.start, GetWindowEnd(as)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedOTLPExport, err)
+	}
+	if e.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedOTLPExport, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, val := range e.headers {
+		req.Header.Set(k, val)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedOTLPExport, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%w: unexpected status code: %d: %s", ErrFailedOTLPExport, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
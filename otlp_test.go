@@ -0,0 +1,107 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOTLPRequest(t *testing.T) {
+	start, ts := time.Unix(1, 0), time.Unix(2, 0)
+	req := NewOTLPRequest([]Sample{
+		{Name: "total_cost", Help: "Total cost.", Type: dto.MetricType_GAUGE, Labels: prometheus.Labels{"namespace": "a", "pod": ""}, Value: 1},
+		{Name: "total_cost", Type: dto.MetricType_GAUGE, Labels: prometheus.Labels{"namespace": "b"}, Value: 2},
+		{Name: "dropped_series_total", Type: dto.MetricType_COUNTER, Value: 3},
+		// Non-finite samples are skipped.
+		{Name: "total_cost", Type: dto.MetricType_GAUGE, Labels: prometheus.Labels{"namespace": "c"}, Value: math.NaN()},
+		{Name: "cpu_efficiency", Type: dto.MetricType_GAUGE, Value: math.Inf(1)},
+	}, map[string]string{"k8s.cluster.name": "x"}, start, ts)
+	b, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "k8s.cluster.name", "value": {"stringValue": "x"}}]},
+		"scopeMetrics": [{
+			"scope": {"name": "k8s-kubecost-exporter"},
+			"metrics": [
+				{"name": "total_cost", "description": "Total cost.", "gauge": {"dataPoints": [
+					{"attributes": [{"key": "namespace", "value": {"stringValue": "a"}}], "timeUnixNano": "2000000000", "asDouble": 1},
+					{"attributes": [{"key": "namespace", "value": {"stringValue": "b"}}], "timeUnixNano": "2000000000", "asDouble": 2}
+				]}},
+				{"name": "dropped_series_total", "sum": {"dataPoints": [
+					{"startTimeUnixNano": "1000000000", "timeUnixNano": "2000000000", "asDouble": 3}
+				], "aggregationTemporality": 2, "isMonotonic": true}}
+			]
+		}]
+	}]}`, string(b))
+}
+
+func TestOTLPExporterRecord(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		zr, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(zr).Decode(&got))
+	}))
+	defer srv.Close()
+	v := NewTestConfig([]byte(`otlp:
+  endpoint: ` + srv.URL + `/
+  compression: gzip
+  headers:
+    Authorization: Bearer token
+  resource_attributes:
+    - key: k8s.cluster.name
+      value: x
+`))
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "total_cost"})
+	g.Set(1)
+	r.MustRegister(g)
+	e, err := NewOTLPExporter(v, r)
+	assert.NoError(t, err)
+	assert.Equal(t, "x", e.resource["k8s.cluster.name"])
+	assert.Equal(t, OTLPScopeName, e.resource["service.name"])
+	assert.NoError(t, e.Record(nil, nil))
+	assert.Len(t, got["resourceMetrics"], 1)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	assert.ErrorIs(t, e.Record(nil, nil), ErrFailedOTLPExport)
+}
+
+func TestOTLPExporterResource(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  labels:
+    - name: cluster
+      key: cluster
+otlp:
+  endpoint: http://localhost:4318
+`))
+	e, err := NewOTLPExporter(v, prometheus.NewRegistry())
+	assert.NoError(t, err)
+	a := func(cluster string) Allocation {
+		return Allocation{Properties: map[string]any{"cluster": cluster}}
+	}
+	// The cluster defaults to the "cluster" label shared by all allocations.
+	assert.Equal(t, "x", e.Resource([]Allocation{a("x"), a(""), a("x")})[OTLPClusterAttribute])
+	assert.NotContains(t, e.Resource([]Allocation{a("x"), a("y")}), OTLPClusterAttribute)
+	assert.NotContains(t, e.resource, OTLPClusterAttribute)
+
+	v.Set("otlp.cluster", "z")
+	e, err = NewOTLPExporter(v, prometheus.NewRegistry())
+	assert.NoError(t, err)
+	assert.Equal(t, "z", e.Resource([]Allocation{a("x")})[OTLPClusterAttribute])
+}
@@ -0,0 +1,372 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Parquet export.
+//
+// After each cycle, the allocations are written to Parquet files in a
+// directory, one file per window date and query (ex. api-2023-11-14.parquet),
+// and optionally uploaded to S3-compatible object storage (see S3Uploader).
+// Since Parquet files cannot be appended to, each cycle reads the file of the
+// window date back, merges the allocations into its rows (replacing rows of
+// the same window and name), and replaces the file.
+//
+// The schema comprises the following columns:
+//
+//   - query: the name of the query (ex. api)
+//   - the string and numeric fields of the Allocation struct, in order of
+//     definition, named after their JSON names in snake case (ex. name, start,
+//     end, minutes, cpu_cores, ..., total_efficiency)
+//   - the label names (see GetPrometheusMetricsLabelNames), as strings
+//
+// For documentation on Parquet, see the following:
+//   - https://parquet.apache.org/docs/file-format
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ErrFailedParquetExport is returned when allocations cannot be written to a
+// Parquet file.
+var ErrFailedParquetExport = errors.New("Failed to export allocations to Parquet")
+
+// Name of the query column.
+const ParquetQueryColumn = "query"
+
+// Compression codecs of Parquet files.
+var ParquetCompressionCodecs = map[string]parquet.CompressionCodec{
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+}
+
+// An AllocationColumn is a column of an export schema (ex. Parquet, SQL).
+type AllocationColumn struct {
+	Name string
+	// Name of the Allocation field, or of the label if empty.
+	Field string
+	// Whether the column is numeric, rather than a string.
+	Numeric bool
+}
+
+// Get the columns of the Allocation struct: its string and float64 fields, in
+// order of definition. Column names are the JSON names in snake case.
+func GetAllocationColumns() []AllocationColumn {
+	columns := []AllocationColumn{}
+	t := reflect.TypeOf(Allocation{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if k := f.Type.Kind(); k != reflect.String && k != reflect.Float64 {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		columns = append(columns, AllocationColumn{
+			Name:    ToSnakeCase(name),
+			Field:   f.Name,
+			Numeric: f.Type.Kind() == reflect.Float64,
+		})
+	}
+	return columns
+}
+
+// Convert a camel case string to snake case (ex. cpuCoreHours ->
+// cpu_core_hours).
+func ToSnakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ParquetExporter writes allocations to Parquet files. It implements the
+// Recorder interface.
+type ParquetExporter struct {
+	config      *viper.Viper
+	directory   string
+	prefix      string
+	dateFormat  string
+	maxFiles    int
+	compression parquet.CompressionCodec
+	// Nil, unless "parquet.s3.enabled" is true.
+	uploader *S3Uploader
+}
+
+// Create a new ParquetExporter from configuration. The directory is created if
+// it does not exist.
+func NewParquetExporter(v *viper.Viper) (*ParquetExporter, error) {
+	e := &ParquetExporter{
+		config:     v,
+		directory:  v.GetString("parquet.directory"),
+		prefix:     v.GetString("parquet.prefix"),
+		dateFormat: v.GetString("parquet.date_format"),
+		maxFiles:   v.GetInt("parquet.max_files"),
+	}
+	if e.directory == "" {
+		return nil, errors.New("'parquet.directory' is required")
+	}
+	if e.dateFormat == "" {
+		e.dateFormat = "2006-01-02"
+	}
+	compression := v.GetString("parquet.compression")
+	if compression == "" {
+		compression = "snappy"
+	}
+	var ok bool
+	if e.compression, ok = ParquetCompressionCodecs[compression]; !ok {
+		return nil, fmt.Errorf("Unknown 'parquet.compression' '%s'", compression)
+	}
+	if v.GetBool("parquet.s3.enabled") {
+		u, err := NewS3Uploader(v, "parquet.s3")
+		if err != nil {
+			return nil, err
+		}
+		e.uploader = u
+	}
+	if err := os.MkdirAll(e.directory, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating 'parquet.directory': %w", err)
+	}
+	return e, nil
+}
+
+// Get the columns of the schema. Labels whose name is the name of another
+// column are omitted.
+func (e *ParquetExporter) Columns() []AllocationColumn {
+	columns := append([]AllocationColumn{{Name: ParquetQueryColumn}}, GetAllocationColumns()...)
+	seen := map[string]bool{}
+	for _, c := range columns {
+		seen[c.Name] = true
+	}
+	for _, n := range GetPrometheusMetricsLabelNames(e.config) {
+		if !seen[n] {
+			seen[n] = true
+			columns = append(columns, AllocationColumn{Name: n})
+		}
+	}
+	return columns
+}
+
+// Get the name of the file of a query and window start time (ex.
+// api-2023-11-14.parquet).
+func (e *ParquetExporter) FileName(query, start string) string {
+	return e.prefix + query + "-" + FormatWindowDate(start, e.dateFormat) + ".parquet"
+}
+
+// Write the allocations of the main query to files, grouped by window date,
+// and upload them. The allocations are merged into the rows of existing files
+// (see MergeParquetRows). Allocations dropped by relabel configs are skipped.
+func (e *ParquetExporter) Record(_ AllocationAPI, as []Allocation) error {
+	columns := e.Columns()
+	rows := map[string][][]any{}
+	files := []string{}
+	for _, a := range as {
+		ls, ok := NewPrometheusLabelsFromAllocation(e.config, a)
+		if !ok {
+			continue
+		}
+		row := make([]any, len(columns))
+		av := reflect.ValueOf(a)
+		for i, c := range columns {
+			switch {
+			case c.Name == ParquetQueryColumn:
+				row[i] = QueryMain
+			case c.Field != "":
+				row[i] = av.FieldByName(c.Field).Interface()
+			default:
+				row[i] = ls[c.Name]
+			}
+		}
+		name := e.FileName(QueryMain, a.Start)
+		if _, ok := rows[name]; !ok {
+			files = append(files, name)
+		}
+		rows[name] = append(rows[name], row)
+	}
+	errs := []error{}
+	for _, name := range files {
+		merged, err := e.merge(filepath.Join(e.directory, name), columns, rows[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", ErrFailedParquetExport, err))
+			continue
+		}
+		b, err := EncodeParquet(columns, merged, e.compression)
+		if err == nil {
+			err = writeFileAtomic(filepath.Join(e.directory, name), b)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", ErrFailedParquetExport, err))
+			continue
+		}
+		if e.uploader != nil {
+			if err := e.uploader.Put(name, "application/vnd.apache.parquet", b); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := PruneFiles(e.directory, e.prefix, ".parquet", e.maxFiles); err != nil {
+		errs = append(errs, fmt.Errorf("%w: %v", ErrFailedParquetExport, err))
+	}
+	return JoinErrors(errs)
+}
+
+// Merge rows into the rows of an existing file. Files which do not exist are
+// ignored.
+func (e *ParquetExporter) merge(path string, columns []AllocationColumn, rows [][]any) ([][]any, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rows, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing, err := DecodeParquet(b, columns)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read '%s': %v", path, err)
+	}
+	return MergeParquetRows(columns, existing, rows), nil
+}
+
+// Merge rows into existing rows. Rows are keyed by window (start and end) and
+// allocation name: rows replace existing rows with the same key, and other
+// rows are appended.
+func MergeParquetRows(columns []AllocationColumn, existing, rows [][]any) [][]any {
+	key := []int{}
+	for i, c := range columns {
+		if c.Field == "Start" || c.Field == "End" || c.Field == "Name" {
+			key = append(key, i)
+		}
+	}
+	rowKey := func(row []any) string {
+		parts := make([]string, len(key))
+		for i, k := range key {
+			parts[i] = fmt.Sprint(row[k])
+		}
+		return strings.Join(parts, "\xff")
+	}
+	merged := append([][]any{}, existing...)
+	index := make(map[string]int, len(merged))
+	for i, row := range merged {
+		index[rowKey(row)] = i
+	}
+	for _, row := range rows {
+		k := rowKey(row)
+		if i, ok := index[k]; ok {
+			merged[i] = row
+			continue
+		}
+		index[k] = len(merged)
+		merged = append(merged, row)
+	}
+	return merged
+}
+
+// Decode the rows of a Parquet file into the given columns. Values of columns
+// missing from the file (ex. a new label) are zero values.
+func DecodeParquet(b []byte, columns []AllocationColumn) ([][]any, error) {
+	f, err := buffer.NewBufferFile(b)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+	n := pr.GetNumRows()
+	values := map[string][]any{}
+	// The reader renames the schema elements, so the names in the file are
+	// retrieved from the schema handler.
+	for i := range pr.Footer.Schema[1:] {
+		vs, _, _, err := pr.ReadColumnByIndex(int64(i), n)
+		if err != nil {
+			return nil, err
+		}
+		values[pr.SchemaHandler.GetExName(i+1)] = vs
+	}
+	rows := make([][]any, n)
+	for i := range rows {
+		rows[i] = make([]any, len(columns))
+		for j, c := range columns {
+			var v any
+			if vs := values[c.Name]; i < len(vs) {
+				v = vs[i]
+			}
+			switch v.(type) {
+			case float64:
+				if !c.Numeric {
+					v = ""
+				}
+			case string:
+				if c.Numeric {
+					v = 0.0
+				}
+			default:
+				if c.Numeric {
+					v = 0.0
+				} else {
+					v = ""
+				}
+			}
+			rows[i][j] = v
+		}
+	}
+	return rows, nil
+}
+
+// Encode rows as a Parquet file. Values of numeric columns must be float64,
+// and values of other columns strings.
+func EncodeParquet(columns []AllocationColumn, rows [][]any, compression parquet.CompressionCodec) ([]byte, error) {
+	md := make([]string, len(columns))
+	for i, c := range columns {
+		if c.Numeric {
+			md[i] = "name=" + c.Name + ", type=DOUBLE, repetitiontype=REQUIRED"
+		} else {
+			md[i] = "name=" + c.Name + ", type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"
+		}
+	}
+	var buf bytes.Buffer
+	w, err := writer.NewCSVWriterFromWriter(md, &buf, 1)
+	if err != nil {
+		return nil, err
+	}
+	w.CompressionType = compression
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.WriteStop(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write a file by writing a temporary file in the same directory and renaming
+// it, so that readers never see a partially written file.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
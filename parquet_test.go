@@ -0,0 +1,167 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestToSnakeCase(t *testing.T) {
+	assert.Equal(t, "cpu_core_request_average", ToSnakeCase("cpuCoreRequestAverage"))
+	assert.Equal(t, "name", ToSnakeCase("name"))
+}
+
+func TestGetAllocationColumns(t *testing.T) {
+	columns := GetAllocationColumns()
+	assert.Equal(t, AllocationColumn{Name: "name", Field: "Name"}, columns[0])
+	assert.Equal(t, AllocationColumn{Name: "start", Field: "Start"}, columns[1])
+	assert.Equal(t, AllocationColumn{Name: "minutes", Field: "Minutes", Numeric: true}, columns[3])
+	assert.Equal(t, AllocationColumn{Name: "total_efficiency", Field: "TotalEfficiency", Numeric: true}, columns[len(columns)-1])
+	for _, c := range columns {
+		assert.NotContains(t, []string{"properties", "window", "pvs", "raw_allocation_only"}, c.Name)
+	}
+}
+
+// Read the columns of a Parquet file by name.
+func readParquetColumns(t *testing.T, b []byte) map[string][]any {
+	f, err := buffer.NewBufferFile(b)
+	assert.NoError(t, err)
+	pr, err := reader.NewParquetColumnReader(f, 1)
+	assert.NoError(t, err)
+	defer pr.ReadStop()
+	n := pr.GetNumRows()
+	columns := map[string][]any{}
+	// The reader renames the schema elements, so the names in the file are
+	// retrieved from the schema handler.
+	for i := range pr.Footer.Schema[1:] {
+		values, _, _, err := pr.ReadColumnByIndex(int64(i), n)
+		assert.NoError(t, err)
+		columns[pr.SchemaHandler.GetExName(i+1)] = values
+	}
+	return columns
+}
+
+func TestParquetExporterRecord(t *testing.T) {
+	var uploaded string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaded = r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	v := NewTestConfig([]byte(`metrics:
+  labels:
+    - name: namespace
+      key: namespace
+    - name: name
+      key: pod
+  relabel_configs:
+    - source_labels: [namespace]
+      regex: kube-system
+      action: drop
+parquet:
+  directory: ` + dir + `
+  max_files: 1
+  s3:
+    enabled: true
+    endpoint: ` + srv.URL + `
+    bucket: lake
+    access_key_id: key
+    secret_access_key: secret`))
+	e, err := NewParquetExporter(v)
+	assert.NoError(t, err)
+	as := []Allocation{
+		{Name: "a/web", Start: "2023-11-14T00:00:00Z", End: "2023-11-15T00:00:00Z", Properties: map[string]any{"namespace": "a"}, TotalCost: 1.5},
+		{Name: "kube-system/dns", Start: "2023-11-14T00:00:00Z", Properties: map[string]any{"namespace": "kube-system"}, TotalCost: 2},
+		{Name: "b/api", Start: "2023-11-14T00:00:00Z", Properties: map[string]any{"namespace": "b"}, TotalCost: 3, CPUCores: 0.5},
+	}
+	assert.NoError(t, e.Record(nil, as))
+	b, err := os.ReadFile(filepath.Join(dir, "api-2023-11-14.parquet"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/lake/api-2023-11-14.parquet", uploaded)
+	assert.Equal(t, b, body)
+
+	columns := readParquetColumns(t, b)
+	// The "name" label is omitted, since "name" is an Allocation column.
+	assert.Len(t, columns, len(GetAllocationColumns())+2)
+	assert.Equal(t, []any{"api", "api"}, columns["query"])
+	assert.Equal(t, []any{"a/web", "b/api"}, columns["name"])
+	assert.Equal(t, []any{"a", "b"}, columns["namespace"])
+	assert.Equal(t, []any{1.5, 3.0}, columns["total_cost"])
+	assert.Equal(t, []any{0.0, 0.5}, columns["cpu_cores"])
+
+	// Files are replaced, and only the newest file is kept.
+	as[2].Start = "2023-11-15T00:00:00Z"
+	assert.NoError(t, e.Record(nil, as[2:]))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "api-2023-11-15.parquet", entries[0].Name())
+}
+
+func TestParquetExporterRecordMerge(t *testing.T) {
+	dir := t.TempDir()
+	v := NewTestConfig([]byte(`metrics:
+  labels:
+    - name: namespace
+      key: namespace
+parquet:
+  directory: ` + dir))
+	e, err := NewParquetExporter(v)
+	assert.NoError(t, err)
+	// Two cycles of different windows on the same date.
+	assert.NoError(t, e.Record(nil, []Allocation{
+		{Name: "a", Start: "2023-11-14T00:00:00Z", End: "2023-11-14T01:00:00Z", Properties: map[string]any{"namespace": "a"}, TotalCost: 1},
+		{Name: "b", Start: "2023-11-14T00:00:00Z", End: "2023-11-14T01:00:00Z", Properties: map[string]any{"namespace": "b"}, TotalCost: 2},
+	}))
+	assert.NoError(t, e.Record(nil, []Allocation{
+		{Name: "a", Start: "2023-11-14T01:00:00Z", End: "2023-11-14T02:00:00Z", Properties: map[string]any{"namespace": "a"}, TotalCost: 3},
+	}))
+	// Rows of the same window and name are replaced.
+	assert.NoError(t, e.Record(nil, []Allocation{
+		{Name: "b", Start: "2023-11-14T00:00:00Z", End: "2023-11-14T01:00:00Z", Properties: map[string]any{"namespace": "b"}, TotalCost: 4},
+	}))
+	b, err := os.ReadFile(filepath.Join(dir, "api-2023-11-14.parquet"))
+	assert.NoError(t, err)
+	columns := readParquetColumns(t, b)
+	assert.Equal(t, []any{"a", "b", "a"}, columns["name"])
+	assert.Equal(t, []any{"2023-11-14T00:00:00Z", "2023-11-14T00:00:00Z", "2023-11-14T01:00:00Z"}, columns["start"])
+	assert.Equal(t, []any{1.0, 4.0, 3.0}, columns["total_cost"])
+
+	// Columns of new labels are empty in existing rows.
+	v.Set("metrics.labels", []any{
+		map[string]any{"name": "namespace", "key": "namespace"},
+		map[string]any{"name": "team", "key": "labels.team"},
+	})
+	assert.NoError(t, e.Record(nil, []Allocation{
+		{Name: "c", Start: "2023-11-14T02:00:00Z", End: "2023-11-14T03:00:00Z", Properties: map[string]any{"namespace": "c", "labels": map[string]any{"team": "x"}}, TotalCost: 5},
+	}))
+	b, err = os.ReadFile(filepath.Join(dir, "api-2023-11-14.parquet"))
+	assert.NoError(t, err)
+	columns = readParquetColumns(t, b)
+	assert.Equal(t, []any{"a", "b", "a", "c"}, columns["name"])
+	assert.Equal(t, []any{"", "", "", "x"}, columns["team"])
+	assert.Equal(t, []any{1.0, 4.0, 3.0, 5.0}, columns["total_cost"])
+}
+
+func TestNewParquetExporter(t *testing.T) {
+	_, err := NewParquetExporter(NewTestConfig([]byte(`parquet:
+  compression: snappy`)))
+	assert.Error(t, err)
+	_, err = NewParquetExporter(NewTestConfig([]byte(`parquet:
+  directory: ` + t.TempDir() + `
+  compression: zstd`)))
+	assert.Error(t, err)
+}
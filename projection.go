@@ -0,0 +1,160 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Month-end cost projection.
+//
+// The projected end-of-month cost of each label set is extrapolated from its
+// month-to-date cost and its recent daily run-rate:
+//
+//	projected = month-to-date + daily run-rate * days remaining in month
+//
+// The daily run-rate is the cost over the run-rate window (ex. the previous 3
+// days) normalized to a single day.
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// ProjectionMetrics holds the month-to-date, daily run-rate and projected
+// end-of-month metrics for each configured Allocation field. It implements
+// both the Recorder and prometheus.Collector interfaces.
+type ProjectionMetrics struct {
+	config      *viper.Viper
+	interval    time.Duration
+	window      time.Duration
+	last        time.Time
+	MonthToDate PrometheusMetrics
+	RunRate     PrometheusMetrics
+	Projected   PrometheusMetrics
+}
+
+// Create new ProjectionMetrics from configuration.
+//
+// Metric names are formed by prefixing each element in "projection.names"
+// with "month_to_date_", "daily_run_rate_" and "projected_month_end_".
+func NewProjectionMetrics(v *viper.Viper) *ProjectionMetrics {
+	names := GetNameFieldMappings(v, "projection.names")
+	interval, err := ParseDuration(v.GetString("projection.update_interval"))
+	if err != nil {
+		logger.Printf("Error parsing 'projection.update_interval' config: %v. Defaulting to 1h", err)
+		interval = time.Hour
+	}
+	window, err := ParseDuration(v.GetString("projection.run_rate_window"))
+	if err != nil || window <= 0 {
+		logger.Printf("Error parsing 'projection.run_rate_window' config: %v. Defaulting to 3d", err)
+		window = 3 * 24 * time.Hour
+	}
+	return &ProjectionMetrics{
+		config:      v,
+		interval:    interval,
+		window:      window,
+		MonthToDate: NewPrometheusMetricsFromNames(v, names, "month_to_date_"),
+		RunRate:     NewPrometheusMetricsFromNames(v, names, "daily_run_rate_"),
+		Projected:   NewPrometheusMetricsFromNames(v, names, "projected_month_end_"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *ProjectionMetrics) Describe(ch chan<- *prometheus.Desc) {
+	p.MonthToDate.Describe(ch)
+	p.RunRate.Describe(ch)
+	p.Projected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *ProjectionMetrics) Collect(ch chan<- prometheus.Metric) {
+	p.MonthToDate.Collect(ch)
+	p.RunRate.Collect(ch)
+	p.Projected.Collect(ch)
+}
+
+// Get the month-to-date and run-rate windows for the given time.
+//
+// Both windows end at the start of the current minute. The month-to-date
+// window starts at the beginning of the current month.
+func GetProjectionWindows(now time.Time, runRate time.Duration) (mtd, rr [2]time.Time) {
+	end := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location())
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return [2]time.Time{start, end}, [2]time.Time{end.Add(-runRate), end}
+}
+
+// Project the end-of-month value from the month-to-date value and the value
+// over the run-rate window.
+//
+// Returns the daily run-rate and the projected end-of-month value.
+func Project(mtd, rr float64, runRate time.Duration, end time.Time) (float64, float64) {
+	day := 24 * time.Hour
+	daily := rr * float64(day) / float64(runRate)
+	// The first day of the next month. time.Date normalizes month 13 to January
+	// of the following year.
+	eom := time.Date(end.Year(), end.Month()+1, 1, 0, 0, 0, 0, end.Location())
+	remaining := float64(eom.Sub(end)) / float64(day)
+	return daily, mtd + daily*remaining
+}
+
+// Retrieve month-to-date and run-rate cost allocation data and update
+// metrics.
+//
+// Since the month-to-date window may be large, the Allocation API is queried
+// at most once per "projection.update_interval".
+func (p *ProjectionMetrics) Record(c AllocationAPI, _ []Allocation) error {
+	now := Now()
+	if !p.last.IsZero() && now.Sub(p.last) < p.interval {
+		return nil
+	}
+	mtdWindow, rrWindow := GetProjectionWindows(now, p.window)
+	mtd, err := p.query(c, mtdWindow)
+	if err != nil {
+		return err
+	}
+	rr, err := p.query(c, rrWindow)
+	if err != nil {
+		return err
+	}
+	// Label sets that only appear in the run-rate window (ex. at the start of
+	// the month, when the run-rate window spans the previous month) have a
+	// month-to-date value of 0.
+	for k, r := range rr {
+		if _, ok := mtd[k]; !ok {
+			mtd[k] = &LabelSetValues{Labels: r.Labels, Values: map[string]float64{}}
+		}
+	}
+	// Remove label sets which are no longer present in either window.
+	for field := range p.Projected {
+		p.MonthToDate[field].Reset()
+		p.RunRate[field].Reset()
+		p.Projected[field].Reset()
+	}
+	for k, m := range mtd {
+		for field := range p.Projected {
+			var r float64
+			if _, ok := rr[k]; ok {
+				r = rr[k].Values[field]
+			}
+			daily, projected := Project(m.Values[field], r, p.window, mtdWindow[1])
+			p.MonthToDate[field].With(m.Labels).Set(m.Values[field])
+			p.RunRate[field].With(m.Labels).Set(daily)
+			p.Projected[field].With(m.Labels).Set(projected)
+		}
+	}
+	p.last = now
+	return nil
+}
+
+// Query the Allocation API for the given window and sum values by label set.
+func (p *ProjectionMetrics) query(c AllocationAPI, window [2]time.Time) (map[string]*LabelSetValues, error) {
+	as, err := GetAllocationForWindow(c, p.config, QueryProjection, window[0], window[1])
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, 0, len(p.Projected))
+	for field := range p.Projected {
+		fields = append(fields, field)
+	}
+	return SumByLabels(p.config, as, fields), nil
+}
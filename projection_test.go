@@ -0,0 +1,129 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetProjectionWindows(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "1970-01-15T12:30:45Z")
+	mtd, rr := GetProjectionWindows(now, 72*time.Hour)
+	assert.Equal(t, "1970-01-01T00:00:00Z,1970-01-15T12:30:00Z", FormatWindow(mtd[0], mtd[1]))
+	assert.Equal(t, "1970-01-12T12:30:00Z,1970-01-15T12:30:00Z", FormatWindow(rr[0], rr[1]))
+}
+
+func TestProject(t *testing.T) {
+	cases := []struct {
+		mtd           float64
+		rr            float64
+		runRate       time.Duration
+		end           string
+		wantDaily     float64
+		wantProjected float64
+	}{
+		// 30 days remaining in January.
+		{
+			mtd:           10,
+			rr:            30,
+			runRate:       72 * time.Hour,
+			end:           "1970-01-02T00:00:00Z",
+			wantDaily:     10,
+			wantProjected: 310,
+		},
+		// Half a day remaining in December.
+		{
+			mtd:           100,
+			rr:            2,
+			runRate:       24 * time.Hour,
+			end:           "1970-12-31T12:00:00Z",
+			wantDaily:     2,
+			wantProjected: 101,
+		},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			end, _ := time.Parse(time.RFC3339, tc.end)
+			daily, projected := Project(tc.mtd, tc.rr, tc.runRate, end)
+			assert.InDelta(t, tc.wantDaily, daily, 1e-9)
+			assert.InDelta(t, tc.wantProjected, projected, 1e-9)
+		})
+	}
+}
+
+func TestProjectionMetricsRecord(t *testing.T) {
+	DisableLogger()
+	Now = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "1970-01-02T00:00:00Z")
+		return t
+	}
+	defer func() { Now = time.Now }()
+	v := NewTestConfig([]byte(`api:
+  host: localhost
+  port: 9003
+  path: /allocation/compute
+  parameters:
+    window: 1m
+    aggregate: namespace
+metrics:
+  namespace: kubecost
+  names: []
+  labels:
+    - name: namespace
+      key: namespace
+projection:
+  update_interval: 1h
+  run_rate_window: 3d
+  names:
+    - name: total_cost
+      field: TotalCost
+`))
+	ctrl := gomock.NewController(t)
+	c := NewMockAllocationAPI(ctrl)
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1970-01-01T00:00:00Z,1970-01-02T00:00:00Z",
+		"aggregate": "namespace",
+	}).Return("mtd")
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", map[string]any{
+		"window":    "1969-12-30T00:00:00Z,1970-01-02T00:00:00Z",
+		"aggregate": "namespace",
+	}).Return("rr")
+	c.EXPECT().GetAllocation("mtd").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 10},
+	}, nil)
+	c.EXPECT().GetAllocation("rr").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 30},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 3},
+	}, nil)
+	p := NewProjectionMetrics(v)
+	assert.NoError(t, p.Record(c, nil))
+	assert.Equal(t, 10.0, testutil.ToFloat64(p.MonthToDate["TotalCost"].WithLabelValues("a")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(p.RunRate["TotalCost"].WithLabelValues("a")))
+	assert.Equal(t, 310.0, testutil.ToFloat64(p.Projected["TotalCost"].WithLabelValues("a")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(p.MonthToDate["TotalCost"].WithLabelValues("b")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.RunRate["TotalCost"].WithLabelValues("b")))
+	assert.Equal(t, 30.0, testutil.ToFloat64(p.Projected["TotalCost"].WithLabelValues("b")))
+	// Within "projection.update_interval", the Allocation API is not queried.
+	assert.NoError(t, p.Record(c, nil))
+
+	// Label sets which are no longer present are removed.
+	Now = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "1970-01-02T01:00:00Z")
+		return t
+	}
+	c.EXPECT().GetURL("localhost", 9003, "/allocation/compute", gomock.Any()).Return("mtd").Times(2)
+	c.EXPECT().GetAllocation("mtd").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 10},
+	}, nil).Times(2)
+	assert.NoError(t, p.Record(c, nil))
+	assert.Equal(t, 1, testutil.CollectAndCount(p.Projected["TotalCost"]))
+	assert.Equal(t, 1, testutil.CollectAndCount(p.MonthToDate["TotalCost"]))
+	assert.Equal(t, 1, testutil.CollectAndCount(p.RunRate["TotalCost"]))
+}
@@ -0,0 +1,285 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Caching reverse proxy of the Kubecost Allocation API.
+//
+// Requests to the proxy path of the HTTP server are forwarded to the
+// Allocation API (see AllocationAPIClient), so that tools may query the
+// exporter rather than Kubecost. To reduce the load on Kubecost:
+//
+//   - successful responses are cached for a TTL, keyed by the normalized query
+//     (parameters and values sorted)
+//   - identical concurrent requests are coalesced into a single upstream
+//     request
+//   - the number of concurrent upstream requests is limited
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	urlpkg "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// ErrProxyBusy is returned when a request waits too long for an upstream
+// request slot.
+var ErrProxyBusy = errors.New("Too many concurrent requests to Allocation API")
+
+// Results of proxied requests.
+const (
+	// Served from the cache.
+	ProxyResultHit = "hit"
+	// Forwarded to the Allocation API.
+	ProxyResultMiss = "miss"
+	// Served the response of an identical in-flight request.
+	ProxyResultCoalesced = "coalesced"
+	// Failed (ex. the Allocation API is unreachable).
+	ProxyResultError = "error"
+)
+
+// A RawAllocationAPI retrieves raw responses of the Allocation API. It is
+// implemented by AllocationAPIClient.
+type RawAllocationAPI interface {
+	GetRaw(ctx context.Context, url string) (int, []byte, error)
+}
+
+// A proxyResponse is a response of the Allocation API.
+type proxyResponse struct {
+	status  int
+	body    []byte
+	expires time.Time
+}
+
+// A proxyCall is an in-flight upstream request. The response and error are set
+// before done is closed.
+type proxyCall struct {
+	done chan struct{}
+	resp *proxyResponse
+	err  error
+}
+
+// AllocationProxy is a caching reverse proxy of the Allocation API. It
+// implements the http.Handler and prometheus.Collector interfaces.
+type AllocationProxy struct {
+	client     RawAllocationAPI
+	upstream   string
+	ttl        time.Duration
+	maxEntries int
+	queue      time.Duration
+	timeout    time.Duration
+	// Semaphore of upstream requests.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	cache    map[string]*proxyResponse
+	inflight map[string]*proxyCall
+
+	// Number of requests by result.
+	Requests *prometheus.CounterVec
+}
+
+// Create a new AllocationProxy from configuration. Requests are forwarded to
+// the Allocation API at "api.host", "api.port" and "api.path".
+func NewAllocationProxy(v *viper.Viper, c RawAllocationAPI) *AllocationProxy {
+	ttl, err := ParseDuration(v.GetString("proxy.cache_ttl"))
+	if err != nil {
+		logger.Printf("Error parsing 'proxy.cache_ttl' config: %v. Defaulting to 1m", err)
+		ttl = time.Minute
+	}
+	queue, err := ParseDuration(v.GetString("proxy.queue_timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'proxy.queue_timeout' config: %v. Defaulting to 30s", err)
+		queue = 30 * time.Second
+	}
+	timeout, err := ParseDuration(v.GetString("proxy.upstream_timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'proxy.upstream_timeout' config: %v. Defaulting to 1m", err)
+		timeout = time.Minute
+	}
+	concurrency := v.GetInt("proxy.max_concurrency")
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	maxEntries := v.GetInt("proxy.max_entries")
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	upstream := urlpkg.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("%s:%d", v.GetString("api.host"), v.GetInt("api.port")),
+		Path:   v.GetString("api.path"),
+	}
+	return &AllocationProxy{
+		client:     c,
+		upstream:   upstream.String(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		queue:      queue,
+		timeout:    timeout,
+		slots:      make(chan struct{}, concurrency),
+		cache:      map[string]*proxyResponse{},
+		inflight:   map[string]*proxyCall{},
+		Requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: v.GetString("metrics.namespace"),
+				Subsystem: v.GetString("metrics.subsystem"),
+				Name:      "proxy_requests_total",
+				Help:      "Number of requests to the Allocation API proxy by result.",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *AllocationProxy) Describe(ch chan<- *prometheus.Desc) {
+	p.Requests.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *AllocationProxy) Collect(ch chan<- prometheus.Metric) {
+	p.Requests.Collect(ch)
+}
+
+// Normalize a query: parameters are sorted by name, and values of repeated
+// parameters are sorted. Parameters with an empty value are omitted.
+func NormalizeQuery(q urlpkg.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := []string{}
+	for _, k := range keys {
+		vs := append([]string{}, q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			if v != "" {
+				params = append(params, urlpkg.QueryEscape(k)+"="+urlpkg.QueryEscape(v))
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// Forward a request to the Allocation API, or serve it from the cache.
+func (p *AllocationProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeRESTError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	key := NormalizeQuery(r.URL.Query())
+	resp, result, err := p.get(r.Context(), key)
+	p.Requests.WithLabelValues(result).Inc()
+	if err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, ErrProxyBusy) {
+			code = http.StatusServiceUnavailable
+		}
+		writeRESTError(w, code, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Cache", strings.ToUpper(result))
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// Get the response of a normalized query from the cache, from an identical
+// in-flight request, or from the Allocation API. Returns the result (see
+// ProxyResultHit etc.).
+func (p *AllocationProxy) get(ctx context.Context, key string) (*proxyResponse, string, error) {
+	p.mu.Lock()
+	if resp, ok := p.cache[key]; ok && Now().Before(resp.expires) {
+		p.mu.Unlock()
+		return resp, ProxyResultHit, nil
+	}
+	if call, ok := p.inflight[key]; ok {
+		p.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ProxyResultError, ctx.Err()
+		}
+		if call.err != nil {
+			return nil, ProxyResultError, call.err
+		}
+		return call.resp, ProxyResultCoalesced, nil
+	}
+	call := &proxyCall{done: make(chan struct{})}
+	p.inflight[key] = call
+	p.mu.Unlock()
+
+	// The upstream request is not canceled with the request context, since
+	// other requests may be waiting on it. It is bounded by "upstream_timeout"
+	// instead.
+	call.resp, call.err = p.fetch(key)
+
+	p.mu.Lock()
+	delete(p.inflight, key)
+	if call.err == nil && call.resp.status == http.StatusOK && p.ttl > 0 {
+		p.store(key, call.resp)
+	}
+	p.mu.Unlock()
+	close(call.done)
+	if call.err != nil {
+		return nil, ProxyResultError, call.err
+	}
+	return call.resp, ProxyResultMiss, nil
+}
+
+// Forward a normalized query to the Allocation API, waiting at most
+// "queue_timeout" for an upstream request slot and "upstream_timeout" for the
+// response.
+func (p *AllocationProxy) fetch(key string) (*proxyResponse, error) {
+	timer := time.NewTimer(p.queue)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, ErrProxyBusy
+	}
+	defer func() { <-p.slots }()
+	url := p.upstream
+	if key != "" {
+		url += "?" + key
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	status, body, err := p.client.GetRaw(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyResponse{status: status, body: body, expires: Now().Add(p.ttl)}, nil
+}
+
+// Store a response in the cache. Expired responses are evicted, and if the
+// cache is full, the response expiring first is evicted. Must be called with
+// p.mu held.
+func (p *AllocationProxy) store(key string, resp *proxyResponse) {
+	now := Now()
+	for k, r := range p.cache {
+		if !now.Before(r.expires) {
+			delete(p.cache, k)
+		}
+	}
+	for len(p.cache) >= p.maxEntries {
+		var oldest string
+		for k, r := range p.cache {
+			if oldest == "" || r.expires.Before(p.cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(p.cache, oldest)
+	}
+	p.cache[key] = resp
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	urlpkg "net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fakeRawAllocationAPI records requested URLs. Requests block until release
+// is closed, if set, or until the context is done.
+type fakeRawAllocationAPI struct {
+	mu      sync.Mutex
+	urls    []string
+	release chan struct{}
+	// Number of concurrent and maximum concurrent requests.
+	active, peak int32
+	status       int
+	err          error
+}
+
+func (f *fakeRawAllocationAPI) GetRaw(ctx context.Context, url string) (int, []byte, error) {
+	n := atomic.AddInt32(&f.active, 1)
+	defer atomic.AddInt32(&f.active, -1)
+	for {
+		p := atomic.LoadInt32(&f.peak)
+		if n <= p || atomic.CompareAndSwapInt32(&f.peak, p, n) {
+			break
+		}
+	}
+	f.mu.Lock()
+	f.urls = append(f.urls, url)
+	f.mu.Unlock()
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return 0, nil, f.err
+	}
+	status := f.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return status, []byte(`{"code": 200, "data": []}`), nil
+}
+
+func (f *fakeRawAllocationAPI) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.urls)
+}
+
+const proxyTestConfig = `api:
+  host: kubecost
+  port: 9090
+  path: /model/allocation
+proxy:
+  cache_ttl: 1m
+  max_concurrency: 2
+  queue_timeout: 5s
+`
+
+func proxyGet(p *AllocationProxy, query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/model/allocation"+query, nil))
+	return rec
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	q1, _ := urlpkg.ParseQuery("window=1d&aggregate=namespace&filter=&aggregate=cluster")
+	q2, _ := urlpkg.ParseQuery("aggregate=cluster&aggregate=namespace&window=1d")
+	assert.Equal(t, "aggregate=cluster&aggregate=namespace&window=1d", NormalizeQuery(q1))
+	assert.Equal(t, NormalizeQuery(q1), NormalizeQuery(q2))
+}
+
+func TestAllocationProxyCache(t *testing.T) {
+	now := time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return now }
+	defer func() { Now = time.Now }()
+	f := &fakeRawAllocationAPI{}
+	p := NewAllocationProxy(NewTestConfig([]byte(proxyTestConfig)), f)
+
+	rec := proxyGet(p, "?window=1d&aggregate=namespace")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	assert.Equal(t, `{"code": 200, "data": []}`, rec.Body.String())
+	assert.Equal(t, []string{"http://kubecost:9090/model/allocation?aggregate=namespace&window=1d"}, f.urls)
+
+	// Equivalent queries are served from the cache until the TTL expires.
+	rec = proxyGet(p, "?aggregate=namespace&window=1d")
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, 1, f.calls())
+	proxyGet(p, "?window=2d")
+	assert.Equal(t, 2, f.calls())
+	now = now.Add(time.Minute)
+	assert.Equal(t, "MISS", proxyGet(p, "?window=1d&aggregate=namespace").Header().Get("X-Cache"))
+	assert.Equal(t, 3, f.calls())
+
+	// Unsuccessful responses are forwarded, but not cached.
+	f.status = http.StatusInternalServerError
+	assert.Equal(t, http.StatusInternalServerError, proxyGet(p, "?window=3d").Code)
+	proxyGet(p, "?window=3d")
+	assert.Equal(t, 5, f.calls())
+
+	f.err = errors.New("connection refused")
+	assert.Equal(t, http.StatusBadGateway, proxyGet(p, "?window=4d").Code)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.Requests.WithLabelValues(ProxyResultHit)))
+	assert.Equal(t, 5.0, testutil.ToFloat64(p.Requests.WithLabelValues(ProxyResultMiss)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.Requests.WithLabelValues(ProxyResultError)))
+}
+
+func TestAllocationProxyMaxEntries(t *testing.T) {
+	f := &fakeRawAllocationAPI{}
+	p := NewAllocationProxy(NewTestConfig([]byte(proxyTestConfig+"  max_entries: 2\n")), f)
+	proxyGet(p, "?window=1d")
+	proxyGet(p, "?window=2d")
+	proxyGet(p, "?window=3d")
+	assert.Len(t, p.cache, 2)
+	// The response expiring first is evicted.
+	assert.Equal(t, "MISS", proxyGet(p, "?window=1d").Header().Get("X-Cache"))
+}
+
+func TestAllocationProxyCoalescing(t *testing.T) {
+	f := &fakeRawAllocationAPI{release: make(chan struct{})}
+	p := NewAllocationProxy(NewTestConfig([]byte(proxyTestConfig)), f)
+
+	// Identical requests are coalesced, and different requests are limited to
+	// "max_concurrency".
+	queries := []string{"?window=1d", "?window=1d", "?window=1d", "?window=2d", "?window=3d", "?window=4d"}
+	results := make([]string, len(queries))
+	var wg sync.WaitGroup
+	for i, q := range queries {
+		wg.Add(1)
+		go func(i int, q string) {
+			defer wg.Done()
+			results[i] = proxyGet(p, q).Header().Get("X-Cache")
+		}(i, q)
+	}
+	// Wait until requests are blocked upstream.
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&f.active) == 2 }, 5*time.Second, time.Millisecond)
+	close(f.release)
+	wg.Wait()
+
+	assert.Equal(t, 4, f.calls())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&f.peak))
+	coalesced := 0
+	for _, r := range results[:3] {
+		if r == "COALESCED" {
+			coalesced++
+		}
+	}
+	assert.Equal(t, 2, coalesced)
+}
+
+func TestAllocationProxyBusy(t *testing.T) {
+	f := &fakeRawAllocationAPI{release: make(chan struct{})}
+	defer close(f.release)
+	p := NewAllocationProxy(NewTestConfig([]byte(`proxy:
+  max_concurrency: 1
+  queue_timeout: 10ms
+`)), f)
+	go proxyGet(p, "?window=1d")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&f.active) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, proxyGet(p, "?window=2d").Code)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/model/allocation", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAllocationProxyUpstreamTimeout(t *testing.T) {
+	f := &fakeRawAllocationAPI{release: make(chan struct{})}
+	defer close(f.release)
+	p := NewAllocationProxy(NewTestConfig([]byte(`proxy:
+  max_concurrency: 1
+  queue_timeout: 5s
+  upstream_timeout: 10ms
+`)), f)
+	// Hung upstream requests fail, and release their slot.
+	assert.Equal(t, http.StatusBadGateway, proxyGet(p, "?window=1d").Code)
+	assert.Equal(t, http.StatusBadGateway, proxyGet(p, "?window=2d").Code)
+	assert.Equal(t, 2, f.calls())
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.Requests.WithLabelValues(ProxyResultError)))
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Run-once mode for batch deployments (ex. a Kubernetes CronJob).
+//
+// Rather than serving the metrics HTTP endpoint, cost allocation data is
+// retrieved once, and the metrics are pushed to a Prometheus Pushgateway.
+//
+// For documentation on the Pushgateway, see the following:
+//   - https://github.com/prometheus/pushgateway
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/spf13/viper"
+)
+
+// ErrFailedPush is returned when metrics cannot be pushed to the Pushgateway.
+var ErrFailedPush = errors.New("Failed to push metrics to Pushgateway")
+
+// Create a new Pusher of the metrics of g from configuration.
+func NewPusher(v *viper.Viper, g prometheus.Gatherer) (*push.Pusher, error) {
+	url := v.GetString("pushgateway.url")
+	if url == "" {
+		return nil, errors.New("'pushgateway.url' is required")
+	}
+	job := v.GetString("pushgateway.job")
+	if job == "" {
+		job = "kubecost_exporter"
+	}
+	timeout, err := ParseDuration(v.GetString("pushgateway.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'pushgateway.timeout' config: %v. Defaulting to 30s", err)
+		timeout = 30 * time.Second
+	}
+	p := push.New(url, job).Gatherer(g).Client(&http.Client{Timeout: timeout})
+	for name, value := range v.GetStringMapString("pushgateway.grouping") {
+		p = p.Grouping(name, value)
+	}
+	if username := v.GetString("pushgateway.basic_auth.username"); username != "" {
+		p = p.BasicAuth(username, v.GetString("pushgateway.basic_auth.password"))
+	}
+	return p, nil
+}
+
+// Retrieve cost allocation data once, call each Recorder (see RecordOnce) and
+// push the metrics of g to the Pushgateway.
+//
+// If "pushgateway.replace" is true, all metrics with the same grouping key are
+// replaced (PUT). Otherwise, only metrics with the same name are replaced
+// (POST).
+//
+// An error is returned if cost allocation data cannot be retrieved, if any
+// Recorder fails, or if the metrics cannot be pushed. Metrics are pushed even
+// if a Recorder fails, so that the metrics of other Recorders are not lost.
+func RunOnce(c AllocationAPI, v *viper.Viper, g prometheus.Gatherer, rs ...Recorder) error {
+	p, err := NewPusher(v, g)
+	if err != nil {
+		return err
+	}
+	host, port, path, params := v.GetString("api.host"), v.GetInt("api.port"),
+		v.GetString("api.path"), v.GetStringMap("api.parameters")
+	errs, err := recordOnce(c, c.GetURL(host, port, path, params), rs...)
+	if err != nil {
+		return err
+	}
+	if v.GetBool("pushgateway.replace") {
+		err = p.Push()
+	} else {
+		err = p.Add()
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%w: %v", ErrFailedPush, err))
+	}
+	return JoinErrors(errs)
+}
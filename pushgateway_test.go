@@ -0,0 +1,110 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunOnce(t *testing.T) {
+	DisableLogger()
+	var method, path string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	v := NewTestConfig([]byte(`api:
+  host: localhost
+  port: 9003
+  path: /allocation/compute
+  parameters:
+    window: yesterday
+metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+  labels:
+    - name: namespace
+      key: "namespace"
+pushgateway:
+  url: ` + srv.URL + `
+  job: kubecost
+  grouping:
+    cluster: x
+  replace: true
+`))
+	ctrl := gomock.NewController(t)
+	c := NewMockAllocationAPI(ctrl)
+	// The URL is generated by AllocationAPIClient, so that the window which is
+	// queried is tested.
+	c.EXPECT().GetURL(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(AllocationAPIClient{}.GetURL).Times(2)
+	url := "http://localhost:9003/allocation/compute?window=yesterday"
+	c.EXPECT().GetAllocation(url).Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 1},
+	}, nil)
+	m := NewAllocationMetrics(v)
+	r := prometheus.NewRegistry()
+	r.MustRegister(m)
+	assert.NoError(t, RunOnce(c, v, r, m))
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "/metrics/job/kubecost/cluster/x", path)
+	assert.NotEmpty(t, body)
+	// An error is returned if cost allocation data cannot be retrieved.
+	c.EXPECT().GetAllocation(url).Return(nil, ErrFailedAllocationAPICall)
+	assert.ErrorIs(t, RunOnce(c, v, r, m), ErrFailedAllocationAPICall)
+}
+
+// A failingRecorder returns an error from Record.
+type failingRecorder struct {
+	err error
+}
+
+func (f failingRecorder) Record(_ AllocationAPI, _ []Allocation) error {
+	return f.err
+}
+
+func TestRunOnceRecorderError(t *testing.T) {
+	DisableLogger()
+	pushed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	v := NewTestConfig([]byte(`metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+  labels:
+    - name: namespace
+      key: "namespace"
+pushgateway:
+  url: ` + srv.URL + `
+`))
+	ctrl := gomock.NewController(t)
+	c := NewMockAllocationAPI(ctrl)
+	c.EXPECT().GetURL(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("url")
+	c.EXPECT().GetAllocation("url").Return([]Allocation{
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 1},
+	}, nil)
+	m := NewAllocationMetrics(v)
+	r := prometheus.NewRegistry()
+	r.MustRegister(m)
+	// Errors of secondary Recorders are returned, after the metrics of other
+	// Recorders are pushed.
+	err := RunOnce(c, v, r, m, failingRecorder{err: ErrFailedExport})
+	assert.ErrorIs(t, err, ErrFailedExport)
+	assert.True(t, pushed)
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Relabeling of Prometheus metric labels.
+//
+// Relabel configs are modelled after Prometheus' relabel_config. They are
+// evaluated in order for each allocation, after labels are created from the
+// Allocation API response and before metrics are updated.
+//
+// For documentation on Prometheus' relabel_config, see the following:
+//   - https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Relabel actions.
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelHashMod   = "hashmod"
+	RelabelLowercase = "lowercase"
+)
+
+// A RelabelConfig rewrites labels or drops an allocation.
+type RelabelConfig struct {
+	SourceLabels []string
+	Separator    string
+	// Regex is anchored on both ends.
+	Regex       *regexp.Regexp
+	Modulus     uint64
+	TargetLabel string
+	Replacement string
+	Action      string
+}
+
+// Get relabel configs from configuration.
+//
+// Defaults are the same as those of Prometheus, that is, an action of
+// "replace", a separator of ";", a regex of "(.*)" and a replacement of "$1".
+func GetRelabelConfigs(v *viper.Viper) ([]RelabelConfig, error) {
+	items, _ := v.Get("metrics.relabel_configs").([]any)
+	cfgs := make([]RelabelConfig, len(items))
+	for i, item := range items {
+		m := item.(map[string]any)
+		cfg := RelabelConfig{
+			SourceLabels: cast.ToStringSlice(m["source_labels"]),
+			Separator:    ";",
+			Modulus:      cast.ToUint64(m["modulus"]),
+			TargetLabel:  GetElementOrZeroValue[string]("target_label", m),
+			Replacement:  "$1",
+			Action:       strings.ToLower(GetElementOrZeroValue[string]("action", m)),
+		}
+		if s, ok := m["separator"].(string); ok {
+			cfg.Separator = s
+		}
+		if s, ok := m["replacement"].(string); ok {
+			cfg.Replacement = s
+		}
+		if cfg.Action == "" {
+			cfg.Action = RelabelReplace
+		}
+		regex := "(.*)"
+		if s, ok := m["regex"].(string); ok {
+			regex = s
+		}
+		var err error
+		if cfg.Regex, err = regexp.Compile("^(?:" + regex + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid regex in relabel config %d: %w", i, err)
+		}
+		switch cfg.Action {
+		case RelabelReplace, RelabelLowercase:
+			if cfg.TargetLabel == "" {
+				return nil, fmt.Errorf("Relabel config %d: 'target_label' is required for action '%s'", i, cfg.Action)
+			}
+		case RelabelHashMod:
+			if cfg.TargetLabel == "" || cfg.Modulus == 0 {
+				return nil, fmt.Errorf("Relabel config %d: 'target_label' and 'modulus' are required for action '%s'", i, cfg.Action)
+			}
+		case RelabelKeep, RelabelDrop, RelabelLabelMap:
+		default:
+			return nil, fmt.Errorf("Relabel config %d: unknown action '%s'", i, cfg.Action)
+		}
+		cfgs[i] = cfg
+	}
+	return cfgs, nil
+}
+
+// Compiled relabel configs by configuration. Labels are created for every
+// allocation, so relabel configs are compiled once per configuration.
+var relabelConfigsCache sync.Map
+
+// Get relabel configs from configuration, compiling them on first use.
+//
+// Invalid relabel configs are logged and ignored. They should be validated at
+// startup using GetRelabelConfigs.
+func getCachedRelabelConfigs(v *viper.Viper) []RelabelConfig {
+	if cfgs, ok := relabelConfigsCache.Load(v); ok {
+		return cfgs.([]RelabelConfig)
+	}
+	cfgs, err := GetRelabelConfigs(v)
+	if err != nil {
+		logger.Printf("%s. Ignoring relabel configs\n", err)
+	}
+	relabelConfigsCache.Store(v, cfgs)
+	return cfgs
+}
+
+// Apply relabel configs to labels.
+//
+// Returns false if the labels are dropped (by a "keep" or "drop" action). As
+// in Prometheus, labels with an empty value are considered absent. The
+// returned labels contain only labels with a non-empty value.
+func Relabel(ls prometheus.Labels, cfgs []RelabelConfig) (prometheus.Labels, bool) {
+	out := prometheus.Labels{}
+	for k, v := range ls {
+		if v != "" {
+			out[k] = v
+		}
+	}
+	for _, cfg := range cfgs {
+		vs := make([]string, len(cfg.SourceLabels))
+		for i, l := range cfg.SourceLabels {
+			vs[i] = out[l]
+		}
+		val := strings.Join(vs, cfg.Separator)
+		switch cfg.Action {
+		case RelabelKeep:
+			if !cfg.Regex.MatchString(val) {
+				return nil, false
+			}
+		case RelabelDrop:
+			if cfg.Regex.MatchString(val) {
+				return nil, false
+			}
+		case RelabelReplace:
+			idx := cfg.Regex.FindStringSubmatchIndex(val)
+			if idx == nil {
+				break
+			}
+			res := string(cfg.Regex.ExpandString([]byte{}, cfg.Replacement, val, idx))
+			setOrDelete(out, cfg.TargetLabel, res)
+		case RelabelLowercase:
+			setOrDelete(out, cfg.TargetLabel, strings.ToLower(val))
+		case RelabelHashMod:
+			sum := md5.Sum([]byte(val))
+			mod := binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus
+			out[cfg.TargetLabel] = fmt.Sprintf("%d", mod)
+		case RelabelLabelMap:
+			// Iterate over a copy, since labels are added to out.
+			for k, v := range copyLabels(out) {
+				if cfg.Regex.MatchString(k) {
+					out[cfg.Regex.ReplaceAllString(k, cfg.Replacement)] = v
+				}
+			}
+		}
+	}
+	return out, true
+}
+
+// Get the names of labels after applying relabel configs to labels with the
+// given names.
+//
+// Label names are added by the target label of "replace", "lowercase" and
+// "hashmod" actions and by "labelmap" actions. Since metrics require a fixed
+// set of label names, labels absent from a relabeled allocation are given an
+// empty value.
+func GetRelabeledLabelNames(names []string, cfgs []RelabelConfig) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	add := func(n string) {
+		if !seen[n] {
+			seen[n] = true
+			out = append(out, n)
+		}
+	}
+	for _, n := range names {
+		add(n)
+	}
+	for _, cfg := range cfgs {
+		switch cfg.Action {
+		case RelabelReplace, RelabelLowercase, RelabelHashMod:
+			add(cfg.TargetLabel)
+		case RelabelLabelMap:
+			matched := []string{}
+			for _, n := range out {
+				if cfg.Regex.MatchString(n) {
+					matched = append(matched, cfg.Regex.ReplaceAllString(n, cfg.Replacement))
+				}
+			}
+			sort.Strings(matched)
+			for _, n := range matched {
+				add(n)
+			}
+		}
+	}
+	return out
+}
+
+// Set the label to the value, or delete the label if the value is empty.
+func setOrDelete(ls prometheus.Labels, name, value string) {
+	if value == "" {
+		delete(ls, name)
+		return
+	}
+	ls[name] = value
+}
+
+// Returns a shallow copy of labels.
+func copyLabels(ls prometheus.Labels) prometheus.Labels {
+	out := make(prometheus.Labels, len(ls))
+	for k, v := range ls {
+		out[k] = v
+	}
+	return out
+}
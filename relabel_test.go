@@ -0,0 +1,251 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRelabelConfigs(t *testing.T) {
+	cases := []struct {
+		config  []byte
+		wantErr string
+	}{
+		{
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [a]
+      target_label: b
+    - source_labels: [a]
+      action: drop
+    - regex: "label_(.+)"
+      action: labelmap
+    - source_labels: [a]
+      target_label: b
+      modulus: 4
+      action: hashmod
+`),
+		},
+		{
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [a]
+      regex: "("
+      target_label: b
+`),
+			wantErr: "Invalid regex in relabel config 0",
+		},
+		{
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [a]
+`),
+			wantErr: "Relabel config 0: 'target_label' is required for action 'replace'",
+		},
+		{
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [a]
+      target_label: b
+      action: hashmod
+`),
+			wantErr: "Relabel config 0: 'target_label' and 'modulus' are required for action 'hashmod'",
+		},
+		{
+			config: []byte(`metrics:
+  relabel_configs:
+    - action: labeldrop
+`),
+			wantErr: "Relabel config 0: unknown action 'labeldrop'",
+		},
+	}
+	for _, tc := range cases {
+		t.Run("", func(t *testing.T) {
+			_, err := GetRelabelConfigs(NewTestConfig(tc.config))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   []byte
+		ls       prometheus.Labels
+		want     prometheus.Labels
+		wantKeep bool
+	}{
+		{
+			name: "replace - strip prefix",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [controller]
+      regex: "prefix-(.*)"
+      target_label: controller
+`),
+			ls:       prometheus.Labels{"controller": "prefix-api", "namespace": ""},
+			want:     prometheus.Labels{"controller": "api"},
+			wantKeep: true,
+		},
+		{
+			name: "replace - no match",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [controller]
+      regex: "prefix-(.*)"
+      target_label: controller
+`),
+			ls:       prometheus.Labels{"controller": "api"},
+			want:     prometheus.Labels{"controller": "api"},
+			wantKeep: true,
+		},
+		{
+			name: "replace - multiple source labels",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [controllerKind, controller]
+      separator: "/"
+      regex: "(deployment)/(.*)"
+      target_label: workload
+      replacement: "${1}:${2}"
+`),
+			ls:       prometheus.Labels{"controllerKind": "deployment", "controller": "api"},
+			want:     prometheus.Labels{"controllerKind": "deployment", "controller": "api", "workload": "deployment:api"},
+			wantKeep: true,
+		},
+		{
+			name: "replace - empty result deletes target label",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [missing]
+      target_label: controller
+`),
+			ls:       prometheus.Labels{"controller": "api"},
+			want:     prometheus.Labels{},
+			wantKeep: true,
+		},
+		{
+			name: "keep",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [namespace]
+      regex: "team-.*"
+      action: keep
+`),
+			ls:       prometheus.Labels{"namespace": "kube-system"},
+			want:     nil,
+			wantKeep: false,
+		},
+		{
+			name: "drop",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [namespace]
+      regex: "kube-system"
+      action: drop
+`),
+			ls:       prometheus.Labels{"namespace": "kube-system"},
+			want:     nil,
+			wantKeep: false,
+		},
+		{
+			name: "drop - no match",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [namespace]
+      regex: "kube-system"
+      action: drop
+`),
+			ls:       prometheus.Labels{"namespace": "kube-system-2"},
+			want:     prometheus.Labels{"namespace": "kube-system-2"},
+			wantKeep: true,
+		},
+		{
+			name: "labelmap",
+			config: []byte(`metrics:
+  relabel_configs:
+    - regex: "labels_(.+)"
+      action: labelmap
+`),
+			ls:       prometheus.Labels{"labels_app": "api", "namespace": "a"},
+			want:     prometheus.Labels{"labels_app": "api", "app": "api", "namespace": "a"},
+			wantKeep: true,
+		},
+		{
+			name: "hashmod",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [providerID]
+      target_label: providerID
+      modulus: 8
+      action: hashmod
+`),
+			ls: prometheus.Labels{"providerID": "i-0123456789abcdef0"},
+			// MD5 of "i-0123456789abcdef0" modulo 8.
+			want:     prometheus.Labels{"providerID": "7"},
+			wantKeep: true,
+		},
+		{
+			name: "lowercase",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [controllerKind]
+      target_label: controllerKind
+      action: lowercase
+`),
+			ls:       prometheus.Labels{"controllerKind": "StatefulSet"},
+			want:     prometheus.Labels{"controllerKind": "statefulset"},
+			wantKeep: true,
+		},
+		{
+			name: "in order",
+			config: []byte(`metrics:
+  relabel_configs:
+    - source_labels: [controllerKind]
+      target_label: controllerKind
+      action: lowercase
+    - source_labels: [controllerKind]
+      regex: "daemonset"
+      action: drop
+`),
+			ls:       prometheus.Labels{"controllerKind": "DaemonSet"},
+			want:     nil,
+			wantKeep: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfgs, err := GetRelabelConfigs(NewTestConfig(tc.config))
+			assert.NoError(t, err)
+			ret, keep := Relabel(tc.ls, cfgs)
+			assert.Equal(t, tc.wantKeep, keep)
+			assert.Equal(t, tc.want, ret)
+		})
+	}
+}
+
+func TestGetRelabeledLabelNames(t *testing.T) {
+	cfgs, err := GetRelabelConfigs(NewTestConfig([]byte(`metrics:
+  relabel_configs:
+    - source_labels: [controller]
+      target_label: controller
+    - source_labels: [controller]
+      target_label: workload
+    - regex: "labels_(.+)"
+      action: labelmap
+    - source_labels: [namespace]
+      action: drop
+`)))
+	assert.NoError(t, err)
+	ret := GetRelabeledLabelNames([]string{"controller", "labels_b", "labels_a"}, cfgs)
+	assert.Equal(t, []string{"controller", "labels_b", "labels_a", "workload", "a", "b"}, ret)
+}
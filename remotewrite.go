@@ -0,0 +1,266 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Prometheus remote_write sink.
+//
+// After each cycle, the registry is gathered and its samples are sent to a
+// remote_write endpoint (ex. a Prometheus agent) as a snappy-compressed
+// protobuf WriteRequest. Samples are timestamped with the end of the window
+// of the cycle's allocations.
+//
+// Since sinks run on the collection goroutine, the total time spent sending
+// (and retrying) requests in each cycle is bounded by
+// "remote_write.max_retry_duration".
+//
+// For documentation on the remote_write protocol, see the following:
+//   - https://prometheus.io/docs/concepts/remote_write_spec
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ErrFailedRemoteWrite is returned when an error or bad response is returned
+// by the remote_write endpoint.
+var ErrFailedRemoteWrite = errors.New("Failed to send samples to remote_write endpoint")
+
+// A recoverableError is returned when a request may succeed if retried (ex. on
+// a 5xx status code).
+type recoverableError struct {
+	error
+}
+
+// RemoteWriter sends gathered samples to a remote_write endpoint. It
+// implements the Recorder interface.
+//
+// Requests which fail after all retries are queued and retried on the next
+// cycle. If the queue is full, the oldest request is dropped.
+type RemoteWriter struct {
+	gatherer   prometheus.Gatherer
+	client     *http.Client
+	url        string
+	username   string
+	password   string
+	maxSamples int
+	maxRetries int
+	backoff    time.Duration
+	// Maximum total time of sending requests in a cycle.
+	maxDuration time.Duration
+	capacity    int
+	// Queue of encoded, compressed requests.
+	queue [][]byte
+}
+
+// Create a new RemoteWriter from configuration. Samples are gathered from g.
+func NewRemoteWriter(v *viper.Viper, g prometheus.Gatherer) (*RemoteWriter, error) {
+	url := v.GetString("remote_write.url")
+	if url == "" {
+		return nil, errors.New("'remote_write.url' is required")
+	}
+	timeout, err := ParseDuration(v.GetString("remote_write.timeout"))
+	if err != nil {
+		logger.Printf("Error parsing 'remote_write.timeout' config: %v. Defaulting to 30s", err)
+		timeout = 30 * time.Second
+	}
+	backoff, err := ParseDuration(v.GetString("remote_write.min_backoff"))
+	if err != nil {
+		logger.Printf("Error parsing 'remote_write.min_backoff' config: %v. Defaulting to 1s", err)
+		backoff = time.Second
+	}
+	maxDuration, err := ParseDuration(v.GetString("remote_write.max_retry_duration"))
+	if err != nil || maxDuration <= 0 {
+		logger.Printf("Error parsing 'remote_write.max_retry_duration' config: %v. Defaulting to 10s", err)
+		maxDuration = 10 * time.Second
+	}
+	password := v.GetString("remote_write.basic_auth.password")
+	if f := v.GetString("remote_write.basic_auth.password_file"); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading 'remote_write.basic_auth.password_file': %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	w := &RemoteWriter{
+		gatherer:    g,
+		client:      &http.Client{Timeout: timeout},
+		url:         url,
+		username:    v.GetString("remote_write.basic_auth.username"),
+		password:    password,
+		maxSamples:  v.GetInt("remote_write.max_samples_per_send"),
+		maxRetries:  v.GetInt("remote_write.max_retries"),
+		backoff:     backoff,
+		maxDuration: maxDuration,
+		capacity:    v.GetInt("remote_write.queue_capacity"),
+	}
+	if w.maxSamples <= 0 {
+		w.maxSamples = 500
+	}
+	if w.capacity <= 0 {
+		w.capacity = 1
+	}
+	return w, nil
+}
+
+// Gather samples and send them to the remote_write endpoint, along with any
+// queued requests.
+func (w *RemoteWriter) Record(_ AllocationAPI, as []Allocation) error {
+	samples, err := GatherSamples(w.gatherer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedRemoteWrite, err)
+	}
+	ts := GetWindowEnd(as).UnixMilli()
+	for i := 0; i < len(samples); i += w.maxSamples {
+		end := i + w.maxSamples
+		if end > len(samples) {
+			end = len(samples)
+		}
+		w.enqueue(snappy.Encode(nil, EncodeWriteRequest(samples[i:end], ts)))
+	}
+	return w.flush()
+}
+
+// Add a request to the queue, dropping the oldest request if the queue is
+// full.
+func (w *RemoteWriter) enqueue(req []byte) {
+	if len(w.queue) >= w.capacity {
+		logger.Printf("Remote write queue is full. Dropping oldest request\n")
+		w.queue = w.queue[1:]
+	}
+	w.queue = append(w.queue, req)
+}
+
+// Send queued requests in order. Requests which fail with a non-recoverable
+// error (ex. a 4xx status code) are dropped. Sending stops at the first
+// request which fails with a recoverable error after all retries, or once
+// "remote_write.max_retry_duration" has elapsed.
+func (w *RemoteWriter) flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.maxDuration)
+	defer cancel()
+	errs := []error{}
+	for len(w.queue) > 0 {
+		err := w.sendWithRetries(ctx, w.queue[0])
+		var rerr recoverableError
+		if errors.As(err, &rerr) {
+			errs = append(errs, fmt.Errorf("%w: %v. %d requests queued", ErrFailedRemoteWrite, err, len(w.queue)))
+			break
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v. Dropping request", ErrFailedRemoteWrite, err))
+		}
+		w.queue = w.queue[1:]
+	}
+	return JoinErrors(errs)
+}
+
+// Send a request, retrying recoverable errors with exponential backoff. Retries
+// stop when ctx is done.
+func (w *RemoteWriter) sendWithRetries(ctx context.Context, req []byte) error {
+	backoff := w.backoff
+	var err error
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+			backoff *= 2
+		}
+		err = w.send(ctx, req)
+		var rerr recoverableError
+		if err == nil || !errors.As(err, &rerr) {
+			return err
+		}
+	}
+	return err
+}
+
+// Send a request.
+func (w *RemoteWriter) send(ctx context.Context, req []byte) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("User-Agent", "k8s-kubecost-exporter")
+	r.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.username != "" {
+		r.SetBasicAuth(w.username, w.password)
+	}
+	resp, err := w.client.Do(r)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// Encode samples as a protobuf WriteRequest, with the given timestamp in
+// milliseconds.
+//
+// Labels are sorted by name, and labels with an empty value are omitted, as
+// required by the remote_write specification.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func EncodeWriteRequest(samples []Sample, ts int64) []byte {
+	var b []byte
+	for _, s := range samples {
+		ls := make(prometheus.Labels, len(s.Labels)+1)
+		for k, v := range s.Labels {
+			ls[k] = v
+		}
+		ls["__name__"] = s.Name
+		var series []byte
+		for _, n := range (Sample{Labels: ls}).LabelNames() {
+			if ls[n] == "" {
+				continue
+			}
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, n)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, ls[n])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, series)
+	}
+	return b
+}
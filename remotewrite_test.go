@@ -0,0 +1,178 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A decoded TimeSeries of a WriteRequest.
+type testTimeSeries struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64
+}
+
+// Decode a protobuf WriteRequest. Fields are assumed to be well-formed.
+func decodeWriteRequest(t *testing.T, b []byte) []testTimeSeries {
+	fields := func(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte, x uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			assert.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				f(num, typ, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				x, n := protowire.ConsumeFixed64(b)
+				f(num, typ, nil, x)
+				b = b[n:]
+			case protowire.VarintType:
+				x, n := protowire.ConsumeVarint(b)
+				f(num, typ, nil, x)
+				b = b[n:]
+			}
+		}
+	}
+	out := []testTimeSeries{}
+	fields(b, func(_ protowire.Number, _ protowire.Type, series []byte, _ uint64) {
+		ts := testTimeSeries{Labels: map[string]string{}}
+		fields(series, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, value string
+				fields(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				ts.Labels[name] = value
+			case 2:
+				fields(v, func(num protowire.Number, _ protowire.Type, _ []byte, x uint64) {
+					if num == 1 {
+						ts.Value = math.Float64frombits(x)
+					} else {
+						ts.Timestamp = int64(x)
+					}
+				})
+			}
+		})
+		out = append(out, ts)
+	})
+	return out
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	b := EncodeWriteRequest([]Sample{
+		{Name: "kubecost_total_cost", Labels: prometheus.Labels{"namespace": "a", "pod": ""}, Value: 1.5},
+	}, 1672531200000)
+	assert.Equal(t, []testTimeSeries{{
+		Labels:    map[string]string{"__name__": "kubecost_total_cost", "namespace": "a"},
+		Value:     1.5,
+		Timestamp: 1672531200000,
+	}}, decodeWriteRequest(t, b))
+}
+
+func TestRemoteWriterRecord(t *testing.T) {
+	DisableLogger()
+	Now = func() time.Time { return time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC) }
+	defer func() { Now = time.Now }()
+	statuses := []int{http.StatusInternalServerError, http.StatusOK}
+	received := [][]testTimeSeries{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		if status == http.StatusOK {
+			body, _ := io.ReadAll(r.Body)
+			b, err := snappy.Decode(nil, body)
+			assert.NoError(t, err)
+			received = append(received, decodeWriteRequest(t, b))
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	v := NewTestConfig([]byte(`remote_write:
+  url: ` + srv.URL + `
+  basic_auth:
+    username: user
+    password: pass
+  max_samples_per_send: 1
+  max_retries: 1
+  min_backoff: 1ms
+  queue_capacity: 10
+`))
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "total_cost"}, []string{"namespace"})
+	g.WithLabelValues("a").Set(1)
+	g.WithLabelValues("b").Set(2)
+	r.MustRegister(g)
+	w, err := NewRemoteWriter(v, r)
+	assert.NoError(t, err)
+	// The first request is retried once. Samples are timestamped with the end
+	// of the window, rather than the time of collection.
+	assert.NoError(t, w.Record(nil, []Allocation{{End: "2023-01-01T00:00:00Z"}}))
+	assert.Len(t, received, 2)
+	assert.Equal(t, int64(1672531200000), received[0][0].Timestamp)
+	assert.Equal(t, "a", received[0][0].Labels["namespace"])
+	assert.Equal(t, 2.0, received[1][0].Value)
+	// Requests which fail after all retries are queued.
+	statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	assert.ErrorIs(t, w.Record(nil, nil), ErrFailedRemoteWrite)
+	assert.Len(t, w.queue, 2)
+	assert.NoError(t, w.Record(nil, nil))
+	assert.Len(t, w.queue, 0)
+	assert.Len(t, received, 6)
+	// Requests which fail with a non-recoverable error are dropped.
+	statuses = []int{http.StatusBadRequest}
+	assert.ErrorContains(t, w.Record(nil, nil), "unexpected status code: 400")
+	assert.Len(t, w.queue, 0)
+	assert.Len(t, received, 7)
+}
+
+func TestRemoteWriterMaxRetryDuration(t *testing.T) {
+	DisableLogger()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	v := NewTestConfig([]byte(`remote_write:
+  url: ` + srv.URL + `
+  max_retries: 10
+  min_backoff: 1s
+  max_retry_duration: 50ms
+  queue_capacity: 10
+`))
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "total_cost"})
+	r.MustRegister(g)
+	w, err := NewRemoteWriter(v, r)
+	assert.NoError(t, err)
+	// Retries stop once "max_retry_duration" has elapsed, and the request is
+	// queued for the next cycle.
+	start := time.Now()
+	assert.ErrorIs(t, w.Record(nil, nil), ErrFailedRemoteWrite)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Len(t, w.queue, 1)
+}
@@ -0,0 +1,336 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// JSON REST API of the current allocations.
+//
+// The allocations of the latest cycle are served as JSON on the HTTP server,
+// with their labels (see GetPrometheusMetricsLabelNames) and the values of the
+// metrics in "metrics.names", along with the window and the time they were
+// fetched. Allocations may be filtered by label, sorted by any value, label or
+// Allocation field, and limited to the top N.
+//
+//	GET /api/v1/allocations?filter=namespace=~kube-.*&sort=total_cost&order=desc&limit=10
+//
+//	{
+//	  "window": {"start": "2023-11-14T00:00:00Z", "end": "2023-11-15T00:00:00Z"},
+//	  "fetched_at": "2023-11-14T12:00:00Z",
+//	  "total": 42,
+//	  "allocations": [
+//	    {
+//	      "name": "kube-system/coredns",
+//	      "start": "2023-11-14T00:00:00Z",
+//	      "end": "2023-11-15T00:00:00Z",
+//	      "labels": {"namespace": "kube-system"},
+//	      "values": {"total_cost": 1.5}
+//	    }
+//	  ]
+//	}
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// A RESTAllocation is an allocation served by the RESTHandler.
+type RESTAllocation struct {
+	Name   string             `json:"name"`
+	Start  string             `json:"start"`
+	End    string             `json:"end"`
+	Labels prometheus.Labels  `json:"labels"`
+	Values map[string]float64 `json:"values"`
+	// Allocation, for sorting by Allocation fields.
+	allocation Allocation
+}
+
+// A RESTWindow is the window of the allocations: the earliest start and latest
+// end of any allocation.
+type RESTWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// A RESTResponse is the response of the RESTHandler.
+type RESTResponse struct {
+	Window    RESTWindow `json:"window"`
+	FetchedAt time.Time  `json:"fetched_at"`
+	// Number of allocations matching the filters, before the limit is applied.
+	Total       int              `json:"total"`
+	Allocations []RESTAllocation `json:"allocations"`
+}
+
+// A RESTFilter matches allocations by label value, either exactly
+// (label=value), by negation (label!=value) or by regular expression
+// (label=~regex). Regular expressions are anchored.
+type RESTFilter struct {
+	Label  string
+	Value  string
+	Negate bool
+	Regex  *regexp.Regexp
+}
+
+// Parse a filter (ex. namespace=~kube-.*).
+func ParseRESTFilter(s string) (RESTFilter, error) {
+	if l, v, ok := strings.Cut(s, "=~"); ok {
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return RESTFilter{}, fmt.Errorf("Invalid regex in filter '%s': %v", s, err)
+		}
+		return RESTFilter{Label: l, Regex: re}, nil
+	}
+	if l, v, ok := strings.Cut(s, "!="); ok {
+		return RESTFilter{Label: l, Value: v, Negate: true}, nil
+	}
+	if l, v, ok := strings.Cut(s, "="); ok {
+		return RESTFilter{Label: l, Value: v}, nil
+	}
+	return RESTFilter{}, fmt.Errorf("Invalid filter '%s'. Expected label=value, label!=value or label=~regex", s)
+}
+
+// Whether the labels match the filter. Absent labels have an empty value.
+func (f RESTFilter) Match(ls prometheus.Labels) bool {
+	if f.Regex != nil {
+		return f.Regex.MatchString(ls[f.Label])
+	}
+	return (ls[f.Label] == f.Value) != f.Negate
+}
+
+// RESTHandler holds the allocations of the latest cycle and serves them as
+// JSON. It implements the Recorder and http.Handler interfaces.
+type RESTHandler struct {
+	config *viper.Viper
+	mu     sync.RWMutex
+	// Nil until the first cycle.
+	response *RESTResponse
+}
+
+// Create a new RESTHandler from configuration.
+func NewRESTHandler(v *viper.Viper) *RESTHandler {
+	return &RESTHandler{config: v}
+}
+
+// Replace the allocations with the allocations of the cycle. Allocations
+// dropped by relabel configs are skipped.
+func (h *RESTHandler) Record(_ AllocationAPI, as []Allocation) error {
+	names := GetPrometheusMetricsNames(h.config)
+	resp := &RESTResponse{FetchedAt: Now().UTC(), Allocations: make([]RESTAllocation, 0, len(as))}
+	// Times are compared as time.Time, since Kubecost returns times in the
+	// time zone of the cluster. Times which cannot be parsed are ignored.
+	var start, end time.Time
+	for _, a := range as {
+		ls, ok := NewPrometheusLabelsFromAllocation(h.config, a)
+		if !ok {
+			continue
+		}
+		values := make(map[string]float64, len(names))
+		for _, n := range names {
+			values[n["name"]] = a.GetValueByFieldNameFloat(n["field"])
+		}
+		resp.Allocations = append(resp.Allocations, RESTAllocation{
+			Name:       a.Name,
+			Start:      a.Start,
+			End:        a.End,
+			Labels:     ls,
+			Values:     values,
+			allocation: a,
+		})
+		if t, err := time.Parse(time.RFC3339, a.Start); err == nil && (start.IsZero() || t.Before(start)) {
+			start, resp.Window.Start = t, a.Start
+		}
+		if t, err := time.Parse(time.RFC3339, a.End); err == nil && (end.IsZero() || t.After(end)) {
+			end, resp.Window.End = t, a.End
+		}
+	}
+	resp.Total = len(resp.Allocations)
+	h.mu.Lock()
+	h.response = resp
+	h.mu.Unlock()
+	return nil
+}
+
+// Resolve a sort key to a function returning the key of an allocation: a
+// value, a label, or an Allocation column (see GetAllocationColumns), in order
+// of precedence. Returns false if the key is unknown.
+func (h *RESTHandler) sortKeyFunc(key string) (func(RESTAllocation) (any, bool), bool) {
+	for _, n := range GetPrometheusMetricsNames(h.config) {
+		if n["name"] == key {
+			return func(a RESTAllocation) (any, bool) {
+				v, ok := a.Values[key]
+				return v, ok
+			}, true
+		}
+	}
+	if contains(GetPrometheusMetricsLabelNames(h.config), key) {
+		return func(a RESTAllocation) (any, bool) {
+			v, ok := a.Labels[key]
+			return v, ok
+		}, true
+	}
+	for _, c := range GetAllocationColumns() {
+		if c.Name == key {
+			f, _ := reflect.TypeOf(Allocation{}).FieldByName(c.Field)
+			return func(a RESTAllocation) (any, bool) {
+				return reflect.ValueOf(a.allocation).FieldByIndex(f.Index).Interface(), true
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// restSort sorts allocations by precomputed sort keys. Allocations without a
+// key (nil) are sorted last.
+type restSort struct {
+	allocations []RESTAllocation
+	keys        []any
+	desc        bool
+}
+
+func (s restSort) Len() int { return len(s.allocations) }
+
+func (s restSort) Swap(i, j int) {
+	s.allocations[i], s.allocations[j] = s.allocations[j], s.allocations[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+func (s restSort) Less(i, j int) bool {
+	x, y := s.keys[i], s.keys[j]
+	if (x == nil) != (y == nil) {
+		return y == nil
+	}
+	if s.desc {
+		return lessSortKey(y, x)
+	}
+	return lessSortKey(x, y)
+}
+
+// Compare sort keys of the same type.
+func lessSortKey(x, y any) bool {
+	switch x := x.(type) {
+	case float64:
+		yf, _ := y.(float64)
+		return x < yf
+	case string:
+		ys, _ := y.(string)
+		return x < ys
+	}
+	return false
+}
+
+// Serve the allocations matching the query parameters as JSON:
+//
+//   - filter: label filters (see ParseRESTFilter). May be repeated, in which
+//     case allocations must match all filters.
+//   - sort: a value, label or Allocation column (ex. total_cost, namespace,
+//     cpu_cores). Allocations without the key are sorted last. Unknown keys
+//     are rejected.
+//   - order: "desc" (default) or "asc".
+//   - limit: the maximum number of allocations (top N).
+//
+// Returns 503 Service Unavailable until allocations are fetched.
+func (h *RESTHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeRESTError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	h.mu.RLock()
+	resp := h.response
+	h.mu.RUnlock()
+	if resp == nil {
+		writeRESTError(w, http.StatusServiceUnavailable, "Allocations have not been fetched yet")
+		return
+	}
+	q := r.URL.Query()
+	filters := []RESTFilter{}
+	for _, s := range q["filter"] {
+		f, err := ParseRESTFilter(s)
+		if err != nil {
+			writeRESTError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filters = append(filters, f)
+	}
+	desc := true
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		desc = false
+	default:
+		writeRESTError(w, http.StatusBadRequest, fmt.Sprintf("Invalid order '%s'. Expected asc or desc", q.Get("order")))
+		return
+	}
+	var sortKey func(RESTAllocation) (any, bool)
+	if key := q.Get("sort"); key != "" {
+		var ok bool
+		if sortKey, ok = h.sortKeyFunc(key); !ok {
+			writeRESTError(w, http.StatusBadRequest, fmt.Sprintf("Unknown sort key '%s'", key))
+			return
+		}
+	}
+	limit := -1
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeRESTError(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit '%s'", s))
+			return
+		}
+		limit = n
+	}
+
+	out := *resp
+	out.Allocations = make([]RESTAllocation, 0, len(resp.Allocations))
+	for _, a := range resp.Allocations {
+		match := true
+		for _, f := range filters {
+			if !f.Match(a.Labels) {
+				match = false
+				break
+			}
+		}
+		if match {
+			out.Allocations = append(out.Allocations, a)
+		}
+	}
+	if sortKey != nil {
+		// Sort keys are computed once per allocation, rather than once per
+		// comparison.
+		keys := make([]any, len(out.Allocations))
+		for i, a := range out.Allocations {
+			if k, ok := sortKey(a); ok {
+				keys[i] = k
+			}
+		}
+		sort.Stable(restSort{allocations: out.Allocations, keys: keys, desc: desc})
+	}
+	out.Total = len(out.Allocations)
+	if limit >= 0 && limit < len(out.Allocations) {
+		out.Allocations = out.Allocations[:limit]
+	}
+	// The response is encoded before writing the status code, since encoding
+	// fails on values which are not valid JSON numbers (ex. NaN).
+	b, err := json.Marshal(out)
+	if err != nil {
+		writeRESTError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to encode allocations: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// Write an error as JSON.
+func writeRESTError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
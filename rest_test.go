@@ -0,0 +1,135 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRESTFilter(t *testing.T) {
+	f, err := ParseRESTFilter("namespace=~kube-.*")
+	assert.NoError(t, err)
+	assert.True(t, f.Match(prometheus.Labels{"namespace": "kube-system"}))
+	assert.False(t, f.Match(prometheus.Labels{"namespace": "a-kube-system"}))
+
+	f, err = ParseRESTFilter("namespace!=a")
+	assert.NoError(t, err)
+	assert.True(t, f.Match(prometheus.Labels{"namespace": "b"}))
+	assert.False(t, f.Match(prometheus.Labels{"namespace": "a"}))
+
+	f, err = ParseRESTFilter("team=")
+	assert.NoError(t, err)
+	assert.True(t, f.Match(prometheus.Labels{"namespace": "a"}))
+
+	_, err = ParseRESTFilter("namespace")
+	assert.Error(t, err)
+	_, err = ParseRESTFilter("namespace=~(")
+	assert.Error(t, err)
+}
+
+func TestRESTHandler(t *testing.T) {
+	Now = func() time.Time { return time.Date(2023, 11, 14, 12, 0, 0, 0, time.UTC) }
+	defer func() { Now = time.Now }()
+	v := NewTestConfig([]byte(`metrics:
+  names:
+    - name: total_cost
+      field: TotalCost
+  labels:
+    - name: namespace
+      key: namespace`))
+	h := NewRESTHandler(v)
+
+	get := func(query string) (int, RESTResponse) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/allocations"+query, nil))
+		var resp RESTResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	names := func(resp RESTResponse) []string {
+		ns := []string{}
+		for _, a := range resp.Allocations {
+			ns = append(ns, a.Name)
+		}
+		return ns
+	}
+
+	code, _ := get("")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	assert.NoError(t, h.Record(nil, []Allocation{
+		{Name: "a", Start: "2023-11-14T00:00:00Z", End: "2023-11-14T12:00:00Z", Properties: map[string]any{"namespace": "a"}, TotalCost: 2, CPUCores: 3},
+		{Name: "kube-system", Start: "2023-11-13T12:00:00Z", End: "2023-11-14T12:00:00Z", Properties: map[string]any{"namespace": "kube-system"}, TotalCost: 3, CPUCores: 1},
+		{Name: "kube-public", Start: "2023-11-14T00:00:00Z", End: "2023-11-14T12:00:00Z", Properties: map[string]any{"namespace": "kube-public"}, TotalCost: 1, CPUCores: 2},
+	}))
+
+	code, resp := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, RESTWindow{Start: "2023-11-13T12:00:00Z", End: "2023-11-14T12:00:00Z"}, resp.Window)
+	assert.Equal(t, Now(), resp.FetchedAt)
+	assert.Equal(t, 3, resp.Total)
+	assert.Equal(t, []string{"a", "kube-system", "kube-public"}, names(resp))
+	assert.Equal(t, prometheus.Labels{"namespace": "a"}, resp.Allocations[0].Labels)
+	assert.Equal(t, map[string]float64{"total_cost": 2}, resp.Allocations[0].Values)
+
+	cases := []struct {
+		query string
+		total int
+		want  []string
+	}{
+		{"?sort=total_cost", 3, []string{"kube-system", "a", "kube-public"}},
+		{"?sort=total_cost&order=asc&limit=2", 3, []string{"kube-public", "a"}},
+		{"?sort=namespace&order=asc", 3, []string{"a", "kube-public", "kube-system"}},
+		// Allocation fields.
+		{"?sort=cpu_cores", 3, []string{"a", "kube-public", "kube-system"}},
+		{"?filter=namespace=~kube-.*&sort=total_cost&limit=1", 2, []string{"kube-system"}},
+		{"?filter=namespace=~kube-.*&filter=namespace!=kube-system", 1, []string{"kube-public"}},
+		{"?limit=0", 3, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			code, resp := get(c.query)
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, c.total, resp.Total)
+			assert.Equal(t, c.want, names(resp))
+		})
+	}
+
+	for _, q := range []string{"?filter=namespace", "?order=up", "?limit=-1", "?limit=x", "?sort=unknown"} {
+		code, _ := get(q)
+		assert.Equal(t, http.StatusBadRequest, code, q)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/allocations", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// Values which cannot be encoded are an error, rather than an empty body.
+	assert.NoError(t, h.Record(nil, []Allocation{{Name: "a", TotalCost: math.NaN()}}))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/allocations", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Unable to encode allocations")
+}
+
+func TestRESTHandlerWindowOffsets(t *testing.T) {
+	h := NewRESTHandler(NewTestConfig([]byte(`metrics:
+  labels: []`)))
+	// Times with different offsets are compared as instants, rather than
+	// strings.
+	assert.NoError(t, h.Record(nil, []Allocation{
+		{Name: "a", Start: "2023-11-14T01:00:00+02:00", End: "2023-11-14T10:00:00+02:00"},
+		{Name: "b", Start: "2023-11-13T20:00:00-05:00", End: "2023-11-14T05:00:00-05:00"},
+		{Name: "c", Start: "", End: "invalid"},
+	}))
+	assert.Equal(t, RESTWindow{Start: "2023-11-14T01:00:00+02:00", End: "2023-11-14T05:00:00-05:00"}, h.response.Window)
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Local rollups of cost allocation data.
+//
+// Rather than querying the Allocation API once per aggregation (ex. pod,
+// namespace, cluster), the API is queried once at a fine granularity (ex.
+// aggregate=pod) and additional rollups are computed locally by grouping
+// allocations by a list of label names.
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// A Rollup groups allocations by a list of label names.
+type Rollup struct {
+	// Name of the rollup (ex. namespace). Used as a prefix of the metric
+	// names, unless a prefix is configured.
+	Name    string
+	GroupBy []string
+	Metrics PrometheusMetrics
+}
+
+// RollupMetrics holds the metrics of each configured rollup. It implements
+// both the Recorder and prometheus.Collector interfaces.
+type RollupMetrics struct {
+	config  *viper.Viper
+	fields  []string
+	Rollups []Rollup
+}
+
+// Create new RollupMetrics from configuration.
+//
+// For each rollup (ex. namespace) and each element in "rollups.names" (ex.
+// total_cost), a metric is generated with the label names in "group_by" (ex.
+// namespace_total_cost).
+func NewRollupMetrics(v *viper.Viper) *RollupMetrics {
+	names := GetNameFieldMappings(v, "rollups.names")
+	fields := make([]string, len(names))
+	for i, n := range names {
+		fields[i] = n["field"]
+	}
+	items, _ := v.Get("rollups.items").([]any)
+	rollups := []Rollup{}
+	for _, item := range items {
+		m := item.(map[string]any)
+		name := GetElementOrZeroValue[string]("name", m)
+		groupBy := cast.ToStringSlice(m["group_by"])
+		if len(groupBy) == 0 {
+			logger.Printf("Rollup '%s' has no 'group_by' labels. Skipping\n", name)
+			continue
+		}
+		prefix, ok := m["prefix"].(string)
+		if !ok {
+			prefix = name + "_"
+		}
+		rollups = append(rollups, Rollup{
+			Name:    name,
+			GroupBy: groupBy,
+			Metrics: NewPrometheusMetricsWithLabelNames(v, names, prefix, groupBy),
+		})
+	}
+	return &RollupMetrics{
+		config:  v,
+		fields:  fields,
+		Rollups: rollups,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *RollupMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, r := range m.Rollups {
+		r.Metrics.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *RollupMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range m.Rollups {
+		r.Metrics.Collect(ch)
+	}
+}
+
+// Update metrics with the allocations retrieved during the cycle.
+//
+// Allocations are mapped to labels using
+// NewExpandedPrometheusLabelsFromAllocation, so "group_by" may refer to any
+// label, including Kubernetes labels matching "metrics.label_allowlist".
+// Allocations dropped by relabel configs are skipped. Metrics are reset on
+// each update.
+func (m *RollupMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	labels := make([]prometheus.Labels, 0, len(as))
+	kept := make([]Allocation, 0, len(as))
+	for _, a := range as {
+		ls, ok := NewExpandedPrometheusLabelsFromAllocation(m.config, a)
+		if !ok {
+			continue
+		}
+		labels = append(labels, ls)
+		kept = append(kept, a)
+	}
+	for _, r := range m.Rollups {
+		for _, field := range m.fields {
+			r.Metrics[field].Reset()
+		}
+		for _, set := range RollupAllocations(kept, labels, r.GroupBy, m.fields) {
+			for _, field := range m.fields {
+				r.Metrics[field].With(set.Labels).Set(set.Values[field])
+			}
+		}
+	}
+	return nil
+}
+
+// Roll up allocations by the given label names. labels holds the labels of
+// each allocation.
+//
+// Values are aggregated using DefaultAggregation, with the exception of
+// efficiencies, which are recomputed from usage and request sums (see
+// ComputeEfficiencies).
+func RollupAllocations(as []Allocation, labels []prometheus.Labels, groupBy []string, fields []string) []*LabelSetValues {
+	g := NewAggregator(map[string]string{}, fields)
+	groups := map[string][]Allocation{}
+	for i, a := range as {
+		ls := ConformLabels(labels[i], groupBy)
+		g.Add(ls, a)
+		k := GetLabelsKey(ls)
+		groups[k] = append(groups[k], a)
+	}
+	sets := g.Sets()
+	for _, set := range sets {
+		cpu, ram, total := ComputeEfficiencies(groups[GetLabelsKey(set.Labels)])
+		for _, field := range fields {
+			switch field {
+			case "CPUEfficiency":
+				set.Values[field] = cpu
+			case "RAMEfficiency":
+				set.Values[field] = ram
+			case "TotalEfficiency":
+				set.Values[field] = total
+			}
+		}
+	}
+	return sets
+}
+
+// Compute the CPU, RAM and total efficiencies of a group of allocations.
+//
+// As in Kubecost, the CPU (RAM) efficiency is the ratio of usage to requests,
+// where usage and requests are averages weighted by the minutes of each
+// allocation. If there are no requests, the efficiency is 1 if there is usage
+// and cost, otherwise 0. The total efficiency is the average of the CPU and
+// RAM efficiencies, weighted by cost.
+//
+// For the Kubecost `Allocation` methods, see pkg/kubecost/allocation.go in the
+// OpenCost GitHub repository:
+//   - https://github.com/opencost/opencost
+func ComputeEfficiencies(as []Allocation) (cpu, ram, total float64) {
+	var cpuUsage, cpuRequest, cpuCost, ramUsage, ramRequest, ramCost float64
+	for _, a := range as {
+		cpuUsage += a.CPUCoreUsageAverage * a.Minutes
+		cpuRequest += a.CPUCoreRequestAverage * a.Minutes
+		cpuCost += a.CPUCost
+		ramUsage += a.RAMByteUsageAverage * a.Minutes
+		ramRequest += a.RAMByteRequestAverage * a.Minutes
+		ramCost += a.RAMCost
+	}
+	cpu, ram = efficiency(cpuUsage, cpuRequest, cpuCost), efficiency(ramUsage, ramRequest, ramCost)
+	if cpuCost+ramCost > 0 {
+		total = (cpu*cpuCost + ram*ramCost) / (cpuCost + ramCost)
+	}
+	return cpu, ram, total
+}
+
+// Compute an efficiency from usage and requests.
+func efficiency(usage, request, cost float64) float64 {
+	switch {
+	case request > 0:
+		return usage / request
+	case usage > 0 && cost > 0:
+		return 1
+	default:
+		return 0
+	}
+}
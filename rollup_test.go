@@ -0,0 +1,84 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeEfficiencies(t *testing.T) {
+	cases := []struct {
+		name      string
+		as        []Allocation
+		wantCPU   float64
+		wantRAM   float64
+		wantTotal float64
+	}{
+		{
+			name: "weighted by minutes",
+			as: []Allocation{
+				{Minutes: 60, CPUCoreUsageAverage: 1, CPUCoreRequestAverage: 2, CPUCost: 3, RAMByteUsageAverage: 1, RAMByteRequestAverage: 1, RAMCost: 1},
+				{Minutes: 30, CPUCoreUsageAverage: 2, CPUCoreRequestAverage: 2, CPUCost: 1},
+			},
+			wantCPU:   2.0 / 3.0,
+			wantRAM:   1,
+			wantTotal: (2.0/3.0*4 + 1) / 5,
+		},
+		{
+			name:    "no requests",
+			as:      []Allocation{{Minutes: 60, CPUCoreUsageAverage: 1, CPUCost: 1}},
+			wantCPU: 1, wantTotal: 1,
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cpu, ram, total := ComputeEfficiencies(c.as)
+			assert.InDelta(t, c.wantCPU, cpu, 1e-9)
+			assert.InDelta(t, c.wantRAM, ram, 1e-9)
+			assert.InDelta(t, c.wantTotal, total, 1e-9)
+		})
+	}
+}
+
+func TestRollupMetricsRecord(t *testing.T) {
+	DisableLogger()
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  labels:
+    - name: namespace
+      key: "namespace"
+    - name: pod
+      key: "pod"
+rollups:
+  items:
+    - name: namespace
+      group_by: [namespace]
+    - name: all
+      group_by: []
+  names:
+    - name: total_cost
+      field: TotalCost
+    - name: cpu_efficiency
+      field: CPUEfficiency
+`))
+	m := NewRollupMetrics(v)
+	assert.Len(t, m.Rollups, 1)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"namespace": "a", "pod": "x"}, Minutes: 60, TotalCost: 1, CPUCoreUsageAverage: 1, CPUCoreRequestAverage: 1},
+		{Properties: map[string]any{"namespace": "a", "pod": "y"}, Minutes: 60, TotalCost: 2, CPUCoreUsageAverage: 0, CPUCoreRequestAverage: 3},
+		{Properties: map[string]any{"namespace": "b", "pod": "z"}, Minutes: 60, TotalCost: 4},
+	}))
+	r := m.Rollups[0]
+	assert.Equal(t, 2, testutil.CollectAndCount(r.Metrics["TotalCost"], "kubecost_namespace_total_cost"))
+	assert.Equal(t, 3.0, testutil.ToFloat64(r.Metrics["TotalCost"].WithLabelValues("a")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(r.Metrics["TotalCost"].WithLabelValues("b")))
+	assert.Equal(t, 0.25, testutil.ToFloat64(r.Metrics["CPUEfficiency"].WithLabelValues("a")))
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Upload of files to S3-compatible object storage (ex. Amazon S3, MinIO).
+//
+// Objects are uploaded with a single PUT request, using path-style URLs
+// (<endpoint>/<bucket>/<key>) and AWS Signature Version 4.
+//
+// For documentation on AWS Signature Version 4, see the following:
+//   - https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ErrFailedS3Upload is returned when an error or bad response is returned by
+// the object storage endpoint.
+var ErrFailedS3Upload = errors.New("Failed to upload object to S3")
+
+// S3Uploader uploads objects to a bucket of an S3-compatible endpoint.
+type S3Uploader struct {
+	client       *http.Client
+	endpoint     string
+	bucket       string
+	region       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// Create a new S3Uploader from the configuration at key (ex. "parquet.s3").
+//
+// Credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+func NewS3Uploader(v *viper.Viper, key string) (*S3Uploader, error) {
+	u := &S3Uploader{
+		endpoint:     strings.TrimSuffix(v.GetString(key+".endpoint"), "/"),
+		bucket:       v.GetString(key + ".bucket"),
+		region:       v.GetString(key + ".region"),
+		prefix:       v.GetString(key + ".prefix"),
+		accessKey:    v.GetString(key + ".access_key_id"),
+		secretKey:    v.GetString(key + ".secret_access_key"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if u.endpoint == "" || u.bucket == "" {
+		return nil, fmt.Errorf("'%s.endpoint' and '%s.bucket' are required", key, key)
+	}
+	if u.region == "" {
+		u.region = "us-east-1"
+	}
+	if u.accessKey == "" {
+		u.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		u.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	timeout, err := ParseDuration(v.GetString(key + ".timeout"))
+	if err != nil {
+		logger.Printf("Error parsing '%s.timeout' config: %v. Defaulting to 60s", key, err)
+		timeout = 60 * time.Second
+	}
+	u.client = &http.Client{Timeout: timeout}
+	return u, nil
+}
+
+// Upload an object. The key is prefixed with the configured prefix.
+func (u *S3Uploader) Put(key, contentType string, body []byte) error {
+	url := u.endpoint + "/" + awsURIEncode(u.bucket, false) + "/" + awsURIEncode(u.prefix+key, false)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedS3Upload, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if u.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.sessionToken)
+	}
+	sum := sha256.Sum256(body)
+	SignV4(req, hex.EncodeToString(sum[:]), u.accessKey, u.secretKey, u.region, "s3", time.Now())
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedS3Upload, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%w: unexpected status code: %d: %s", ErrFailedS3Upload, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Sign a request with AWS Signature Version 4, given the hex-encoded SHA-256
+// hash of the payload. The Host header and all headers of the request are
+// signed. The X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers are
+// set.
+func SignV4(req *http.Request, payloadHash, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQueryString(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, s := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		",SignedHeaders="+signedHeaders+",Signature="+signature)
+}
+
+// Get the canonical query string of a request: URI-encoded parameters sorted
+// by name.
+func canonicalQueryString(req *http.Request) string {
+	query := req.URL.Query()
+	params := []string{}
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// URI-encode a string as required by AWS Signature Version 4: every byte
+// except unreserved characters is percent-encoded. Slashes are only encoded if
+// encodeSlash is true (ex. in query parameters).
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Compute the HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Share of group totals (ex. each namespace's share of cluster cost).
+//
+// For each configured grouping, values are summed across all allocations in
+// each group, and the ratio of each label set's value to its group total is
+// exported along with the group total itself.
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// A Share of the values of label sets in the totals of a grouping.
+type Share struct {
+	// Name of the grouping (ex. cluster). Used as a prefix of the metric names.
+	Name    string
+	GroupBy []string
+	// Label names of the ratio metrics.
+	labels []string
+	Ratio  PrometheusMetrics
+	Total  PrometheusMetrics
+}
+
+// ShareMetrics holds the ratio and total metrics of each configured grouping.
+// It implements both the Recorder and prometheus.Collector interfaces.
+type ShareMetrics struct {
+	config *viper.Viper
+	fields []string
+	Shares []Share
+}
+
+// Create new ShareMetrics from configuration.
+//
+// For each grouping (ex. cluster) and each element in "shares.names" (ex.
+// total_cost), the following metrics are generated:
+//
+//   - cluster_total_cost_share_ratio, with the label names returned by
+//     GetPrometheusMetricsLabelNames, followed by any label names in
+//     "group_by" not among them.
+//   - cluster_group_total_cost, with the label names in "group_by".
+func NewShareMetrics(v *viper.Viper) *ShareMetrics {
+	names := GetNameFieldMappings(v, "shares.names")
+	fields := make([]string, len(names))
+	for i, n := range names {
+		fields[i] = n["field"]
+	}
+	items, _ := v.Get("shares.items").([]any)
+	shares := []Share{}
+	for _, item := range items {
+		m := item.(map[string]any)
+		name := GetElementOrZeroValue[string]("name", m)
+		groupBy := cast.ToStringSlice(m["group_by"])
+		labels := GetPrometheusMetricsLabelNames(v)
+		for _, l := range groupBy {
+			if !contains(labels, l) {
+				labels = append(labels, l)
+			}
+		}
+		ratio := make([]map[string]string, len(names))
+		total := make([]map[string]string, len(names))
+		for i, n := range names {
+			ratio[i] = map[string]string{"name": n["name"] + "_share_ratio", "field": n["field"]}
+			total[i] = map[string]string{"name": "group_" + n["name"], "field": n["field"]}
+		}
+		shares = append(shares, Share{
+			Name:    name,
+			GroupBy: groupBy,
+			labels:  labels,
+			Ratio:   NewPrometheusMetricsWithLabelNames(v, ratio, name+"_", labels),
+			Total:   NewPrometheusMetricsWithLabelNames(v, total, name+"_", groupBy),
+		})
+	}
+	return &ShareMetrics{
+		config: v,
+		fields: fields,
+		Shares: shares,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *ShareMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range m.Shares {
+		s.Ratio.Describe(ch)
+		s.Total.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *ShareMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range m.Shares {
+		s.Ratio.Collect(ch)
+		s.Total.Collect(ch)
+	}
+}
+
+// Update metrics with the allocations retrieved during the cycle.
+//
+// Allocations dropped by relabel configs are skipped. The ratio is not
+// exported when the group total is 0. Metrics are reset on each update.
+func (m *ShareMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	labels := make([]prometheus.Labels, 0, len(as))
+	kept := make([]Allocation, 0, len(as))
+	for _, a := range as {
+		ls, ok := NewExpandedPrometheusLabelsFromAllocation(m.config, a)
+		if !ok {
+			continue
+		}
+		labels = append(labels, ls)
+		kept = append(kept, a)
+	}
+	for _, s := range m.Shares {
+		series, totals := map[string]*LabelSetValues{}, map[string]*LabelSetValues{}
+		groups := map[string]string{}
+		for i, a := range kept {
+			ls, gls := ConformLabels(labels[i], s.labels), ConformLabels(labels[i], s.GroupBy)
+			k, gk := GetLabelsKey(ls), GetLabelsKey(gls)
+			if _, ok := series[k]; !ok {
+				series[k] = &LabelSetValues{Labels: ls, Values: map[string]float64{}}
+				groups[k] = gk
+			}
+			if _, ok := totals[gk]; !ok {
+				totals[gk] = &LabelSetValues{Labels: gls, Values: map[string]float64{}}
+			}
+			for _, f := range m.fields {
+				x := a.GetValueByFieldNameFloat(f)
+				series[k].Values[f] += x
+				totals[gk].Values[f] += x
+			}
+		}
+		for _, f := range m.fields {
+			s.Ratio[f].Reset()
+			s.Total[f].Reset()
+		}
+		for _, t := range totals {
+			for _, f := range m.fields {
+				s.Total[f].With(t.Labels).Set(t.Values[f])
+			}
+		}
+		for k, sv := range series {
+			t := totals[groups[k]]
+			for _, f := range m.fields {
+				if t.Values[f] != 0 {
+					s.Ratio[f].With(sv.Labels).Set(sv.Values[f] / t.Values[f])
+				}
+			}
+		}
+	}
+	return nil
+}
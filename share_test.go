@@ -0,0 +1,54 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareMetricsRecord(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  labels:
+    - name: namespace
+      key: "namespace"
+    - name: cluster
+      key: "cluster"
+shares:
+  items:
+    - name: cluster
+      group_by: [cluster]
+    - name: all
+      group_by: []
+  names:
+    - name: total_cost
+      field: TotalCost
+`))
+	m := NewShareMetrics(v)
+	r := prometheus.NewPedanticRegistry()
+	r.MustRegister(m)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"cluster": "x", "namespace": "a"}, TotalCost: 1},
+		{Properties: map[string]any{"cluster": "x", "namespace": "b"}, TotalCost: 3},
+		{Properties: map[string]any{"cluster": "y", "namespace": "a"}, TotalCost: 2},
+		{Properties: map[string]any{"cluster": "z", "namespace": "a"}},
+	}))
+	_, err := r.Gather()
+	assert.NoError(t, err)
+	cluster, all := m.Shares[0], m.Shares[1]
+	assert.Equal(t, []string{"namespace", "cluster"}, cluster.labels)
+	// No ratio is exported if the group total is 0.
+	assert.Equal(t, 3, testutil.CollectAndCount(cluster.Ratio["TotalCost"], "kubecost_cluster_total_cost_share_ratio"))
+	assert.Equal(t, 4.0, testutil.ToFloat64(cluster.Total["TotalCost"].WithLabelValues("x")))
+	assert.Equal(t, 0.25, testutil.ToFloat64(cluster.Ratio["TotalCost"].WithLabelValues("a", "x")))
+	assert.Equal(t, 0.75, testutil.ToFloat64(cluster.Ratio["TotalCost"].WithLabelValues("b", "x")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(cluster.Ratio["TotalCost"].WithLabelValues("a", "y")))
+	assert.Equal(t, 6.0, testutil.ToFloat64(all.Total["TotalCost"]))
+	assert.Equal(t, 0.5, testutil.ToFloat64(all.Ratio["TotalCost"].WithLabelValues("b", "x")))
+}
@@ -0,0 +1,297 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Redistribution of the cost of shared (ex. platform) namespaces.
+//
+// Rather than relying on Kubecost's sharedCost, the total cost of the source
+// namespaces of each rule (ex. ingress, monitoring) is allocated to tenant
+// namespaces: evenly, weighted by CPU and RAM cost, or by fixed percentages.
+// Redistributed cost is exported as separate metrics, beside the raw
+// Allocation values.
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Shared cost redistribution methods.
+const (
+	// Split evenly across target namespaces.
+	SharedCostEven = "even"
+	// Split across target namespaces, weighted by CPU and RAM cost.
+	SharedCostWeighted = "weighted"
+	// Split by fixed percentages per target namespace.
+	SharedCostFixed = "fixed"
+)
+
+// A SharedCostRule redistributes the cost of source namespaces.
+type SharedCostRule struct {
+	Name string
+	// Namespaces whose cost is redistributed.
+	Namespaces []string
+	Method     string
+	// Namespaces to which cost is redistributed. If empty, cost is
+	// redistributed to all namespaces which are not the source of any rule.
+	Targets []string
+	// Percentage of the cost by target namespace, for the "fixed" method.
+	Percentages map[string]float64
+}
+
+// Get shared cost rules from configuration.
+func GetSharedCostRules(v *viper.Viper) ([]SharedCostRule, error) {
+	items, _ := v.Get("shared_costs.rules").([]any)
+	rules := make([]SharedCostRule, len(items))
+	for i, item := range items {
+		m := item.(map[string]any)
+		r := SharedCostRule{
+			Name:        GetElementOrZeroValue[string]("name", m),
+			Namespaces:  cast.ToStringSlice(m["namespaces"]),
+			Method:      GetElementOrZeroValue[string]("method", m),
+			Targets:     cast.ToStringSlice(m["targets"]),
+			Percentages: map[string]float64{},
+		}
+		if r.Method == "" {
+			r.Method = SharedCostEven
+		}
+		for ns, p := range cast.ToStringMap(m["percentages"]) {
+			r.Percentages[ns] = cast.ToFloat64(p)
+		}
+		switch r.Method {
+		case SharedCostEven, SharedCostWeighted:
+		case SharedCostFixed:
+			var sum float64
+			for ns, p := range r.Percentages {
+				sum += p
+				if !contains(r.Targets, ns) {
+					r.Targets = append(r.Targets, ns)
+				}
+			}
+			if len(r.Percentages) == 0 || sum > 100 {
+				return nil, fmt.Errorf("Shared cost rule '%s': 'percentages' must be non-empty and sum to at most 100", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("Shared cost rule '%s': unknown method '%s'", r.Name, r.Method)
+		}
+		if len(r.Namespaces) == 0 {
+			return nil, fmt.Errorf("Shared cost rule '%s': 'namespaces' is required", r.Name)
+		}
+		rules[i] = r
+	}
+	return rules, nil
+}
+
+// SharedCostValues holds the values of a label set.
+type SharedCostValues struct {
+	Labels    prometheus.Labels
+	Namespace string
+	// Total cost of the allocations of the label set.
+	Cost float64
+	// CPU and RAM cost of the allocations of the label set.
+	Weight float64
+	// Cost redistributed to the label set.
+	Shared float64
+	// Cost including redistributed cost. The cost of source namespaces is
+	// reduced by the redistributed cost.
+	Total float64
+}
+
+// Redistribute the cost of the source namespaces of each rule to the target
+// namespaces.
+//
+// Cost is first split across target namespaces according to the method of the
+// rule, then across the label sets of each namespace in proportion to their
+// cost (evenly, if the cost of the namespace is 0). Cost which is not
+// redistributed (ex. if percentages sum to less than 100, or there are no
+// targets) remains with the source namespaces. A namespace which is the
+// source of several rules is only redistributed by the first.
+func Redistribute(sets []*SharedCostValues, rules []SharedCostRule) {
+	sources := map[string]int{}
+	for i := len(rules) - 1; i >= 0; i-- {
+		for _, ns := range rules[i].Namespaces {
+			sources[ns] = i
+		}
+	}
+	type namespace struct {
+		cost, weight float64
+		sets         []*SharedCostValues
+	}
+	nss := map[string]*namespace{}
+	order := []string{}
+	for _, s := range sets {
+		s.Shared, s.Total = 0, s.Cost
+		if _, ok := nss[s.Namespace]; !ok {
+			nss[s.Namespace] = &namespace{}
+			order = append(order, s.Namespace)
+		}
+		n := nss[s.Namespace]
+		n.cost += s.Cost
+		n.weight += s.Weight
+		n.sets = append(n.sets, s)
+	}
+	for i, r := range rules {
+		var pool float64
+		for ns, j := range sources {
+			if j == i && nss[ns] != nil {
+				pool += nss[ns].cost
+			}
+		}
+		if pool == 0 {
+			continue
+		}
+		// Compute the share of the pool of each target namespace.
+		targets := r.Targets
+		if len(targets) == 0 {
+			for _, ns := range order {
+				if _, ok := sources[ns]; !ok {
+					targets = append(targets, ns)
+				}
+			}
+		}
+		shares := map[string]float64{}
+		var total float64
+		for _, ns := range targets {
+			n := nss[ns]
+			if n == nil {
+				continue
+			}
+			switch r.Method {
+			case SharedCostFixed:
+				shares[ns] = r.Percentages[ns] / 100
+			case SharedCostWeighted:
+				shares[ns] = n.weight
+			default:
+				shares[ns] = 1
+			}
+			total += shares[ns]
+		}
+		if r.Method == SharedCostWeighted && total == 0 {
+			// Default to an even split if no target has CPU or RAM cost.
+			for ns := range shares {
+				shares[ns] = 1
+			}
+			total = float64(len(shares))
+		}
+		if r.Method == SharedCostFixed {
+			total = 1
+		}
+		var distributed float64
+		for ns, share := range shares {
+			if total == 0 {
+				break
+			}
+			n, amount := nss[ns], pool*share/total
+			for _, s := range n.sets {
+				x := amount / float64(len(n.sets))
+				if n.cost != 0 {
+					x = amount * s.Cost / n.cost
+				}
+				s.Shared += x
+				s.Total += x
+			}
+			distributed += amount
+		}
+		// Reduce the cost of the source namespaces by the redistributed cost.
+		for ns, j := range sources {
+			if j != i || nss[ns] == nil {
+				continue
+			}
+			for _, s := range nss[ns].sets {
+				s.Total -= s.Cost * distributed / pool
+			}
+		}
+	}
+}
+
+// SharedCostMetrics holds the metrics of redistributed cost. It implements both
+// the Recorder and prometheus.Collector interfaces.
+type SharedCostMetrics struct {
+	config *viper.Viper
+	rules  []SharedCostRule
+	// Cost redistributed to each label set.
+	Shared *prometheus.GaugeVec
+	// Total cost of each label set, including redistributed cost.
+	Total *prometheus.GaugeVec
+}
+
+// Create new SharedCostMetrics from configuration. An error is returned if the
+// shared cost rules are invalid.
+//
+// The following metrics are generated with the label names returned by
+// GetPrometheusMetricsLabelNames:
+//
+//   - redistributed_shared_cost
+//   - total_cost_with_shared
+func NewSharedCostMetrics(v *viper.Viper) (*SharedCostMetrics, error) {
+	rules, err := GetSharedCostRules(v)
+	if err != nil {
+		return nil, err
+	}
+	labels := GetPrometheusMetricsLabelNames(v)
+	opts := func(name, help string) prometheus.GaugeOpts {
+		return prometheus.GaugeOpts{
+			Namespace: v.GetString("metrics.namespace"),
+			Subsystem: v.GetString("metrics.subsystem"),
+			Name:      name,
+			Help:      help,
+		}
+	}
+	return &SharedCostMetrics{
+		config: v,
+		rules:  rules,
+		Shared: prometheus.NewGaugeVec(opts("redistributed_shared_cost", "Cost of shared namespaces redistributed to each label set."), labels),
+		Total:  prometheus.NewGaugeVec(opts("total_cost_with_shared", "Total cost of each label set, including redistributed shared cost."), labels),
+	}, nil
+}
+
+// Describe implements prometheus.Collector.
+func (m *SharedCostMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.Shared.Describe(ch)
+	m.Total.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *SharedCostMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.Shared.Collect(ch)
+	m.Total.Collect(ch)
+}
+
+// Update metrics with the allocations retrieved during the cycle.
+//
+// Allocations are mapped to labels using NewPrometheusLabelsFromAllocation.
+// Allocations dropped by relabel configs are skipped. Metrics are reset on
+// each update.
+func (m *SharedCostMetrics) Record(_ AllocationAPI, as []Allocation) error {
+	index := map[string]*SharedCostValues{}
+	sets := []*SharedCostValues{}
+	for _, a := range as {
+		ls, ok := NewPrometheusLabelsFromAllocation(m.config, a)
+		if !ok {
+			continue
+		}
+		ns, _ := a.Properties["namespace"].(string)
+		// Label sets may span several namespaces, so namespaces are part of
+		// the key.
+		k := ns + "/" + GetLabelsKey(ls)
+		s, ok := index[k]
+		if !ok {
+			s = &SharedCostValues{Labels: ls, Namespace: ns}
+			index[k] = s
+			sets = append(sets, s)
+		}
+		s.Cost += a.TotalCost
+		s.Weight += a.CPUCost + a.RAMCost
+	}
+	Redistribute(sets, m.rules)
+	m.Shared.Reset()
+	m.Total.Reset()
+	for _, s := range sets {
+		m.Shared.With(s.Labels).Add(s.Shared)
+		m.Total.With(s.Labels).Add(s.Total)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSharedCostRules(t *testing.T) {
+	rules, err := GetSharedCostRules(NewTestConfig([]byte(`shared_costs:
+  rules:
+    - name: platform
+      namespaces: [ingress]
+    - name: data
+      namespaces: [kafka]
+      method: fixed
+      percentages:
+        a: 60
+`)))
+	assert.NoError(t, err)
+	assert.Equal(t, SharedCostEven, rules[0].Method)
+	assert.Equal(t, []string{"a"}, rules[1].Targets)
+	assert.Equal(t, 60.0, rules[1].Percentages["a"])
+	cases := []struct {
+		config string
+		want   string
+	}{
+		{config: "- name: x\n      namespaces: [a]\n      method: random", want: "unknown method 'random'"},
+		{config: "- name: x\n      method: even", want: "'namespaces' is required"},
+		{config: "- name: x\n      namespaces: [a]\n      method: fixed\n      percentages:\n        b: 101", want: "sum to at most 100"},
+	}
+	for _, c := range cases {
+		_, err := GetSharedCostRules(NewTestConfig([]byte("shared_costs:\n  rules:\n    " + c.config + "\n")))
+		assert.ErrorContains(t, err, c.want)
+	}
+}
+
+func TestRedistribute(t *testing.T) {
+	newSets := func() []*SharedCostValues {
+		return []*SharedCostValues{
+			{Namespace: "ingress", Cost: 10},
+			{Namespace: "a", Cost: 3, Weight: 1},
+			{Namespace: "a", Cost: 1, Weight: 2},
+			{Namespace: "b", Cost: 4, Weight: 1},
+		}
+	}
+	cases := []struct {
+		name       string
+		rule       SharedCostRule
+		wantShared []float64
+		wantTotal  []float64
+	}{
+		{
+			name:       "even",
+			rule:       SharedCostRule{Namespaces: []string{"ingress"}, Method: SharedCostEven},
+			wantShared: []float64{0, 3.75, 1.25, 5},
+			wantTotal:  []float64{0, 6.75, 2.25, 9},
+		},
+		{
+			name:       "weighted",
+			rule:       SharedCostRule{Namespaces: []string{"ingress"}, Method: SharedCostWeighted},
+			wantShared: []float64{0, 5.625, 1.875, 2.5},
+			wantTotal:  []float64{0, 8.625, 2.875, 6.5},
+		},
+		{
+			name: "fixed",
+			rule: SharedCostRule{
+				Namespaces:  []string{"ingress"},
+				Method:      SharedCostFixed,
+				Targets:     []string{"b"},
+				Percentages: map[string]float64{"b": 40},
+			},
+			wantShared: []float64{0, 0, 0, 4},
+			wantTotal:  []float64{6, 3, 1, 8},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sets := newSets()
+			Redistribute(sets, []SharedCostRule{c.rule})
+			for i, s := range sets {
+				assert.InDelta(t, c.wantShared[i], s.Shared, 1e-9, i)
+				assert.InDelta(t, c.wantTotal[i], s.Total, 1e-9, i)
+			}
+		})
+	}
+}
+
+func TestSharedCostMetricsRecord(t *testing.T) {
+	v := NewTestConfig([]byte(`metrics:
+  namespace: kubecost
+  labels:
+    - name: namespace
+      key: "namespace"
+shared_costs:
+  rules:
+    - name: platform
+      namespaces: [ingress]
+`))
+	m, err := NewSharedCostMetrics(v)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Record(nil, []Allocation{
+		{Properties: map[string]any{"namespace": "ingress"}, TotalCost: 4},
+		{Properties: map[string]any{"namespace": "a"}, TotalCost: 1},
+		{Properties: map[string]any{"namespace": "b"}, TotalCost: 2},
+	}))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.Shared.WithLabelValues("a")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(m.Total.WithLabelValues("b")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.Total.WithLabelValues("ingress")))
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Utilities shared by sinks, that is, Recorders which push metrics to other
+// systems after each cycle, rather than exposing them via the HTTP metrics
+// endpoint.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+// A Sample is a single value of a gathered metric.
+type Sample struct {
+	Name   string
+	Help   string
+	Type   dto.MetricType
+	Labels prometheus.Labels
+	Value  float64
+}
+
+// Get the label names of the sample in lexicographic order.
+func (s Sample) LabelNames() []string {
+	names := make([]string, 0, len(s.Labels))
+	for n := range s.Labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Gather the samples of all metrics of a Gatherer (ex. a Registry).
+//
+// Only counters, gauges and untyped metrics are supported. Other metric types
+// (ex. histograms) are skipped.
+func GatherSamples(g prometheus.Gatherer) ([]Sample, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	samples := []Sample{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var v float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				v = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				v = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				v = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			ls := make(prometheus.Labels, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				ls[l.GetName()] = l.GetValue()
+			}
+			samples = append(samples, Sample{
+				Name:   mf.GetName(),
+				Help:   mf.GetHelp(),
+				Type:   mf.GetType(),
+				Labels: ls,
+				Value:  v,
+			})
+		}
+	}
+	return samples, nil
+}
+
+// Get the end of the window of the allocations, that is, the latest end time
+// of any allocation. Defaults to the current time if no end time can be
+// parsed.
+func GetWindowEnd(as []Allocation) time.Time {
+	var end time.Time
+	for _, a := range as {
+		t, err := time.Parse(time.RFC3339, a.End)
+		if err == nil && t.After(end) {
+			end = t
+		}
+	}
+	if end.IsZero() {
+		return Now()
+	}
+	return end
+}
+
+// Data of naming templates (ex. InfluxDB measurement, Graphite path).
+type SinkName struct {
+	// Values of "metrics.namespace" and "metrics.subsystem".
+	Namespace string
+	Subsystem string
+	// Name of the metric without the namespace and subsystem (ex. total_cost).
+	Name string
+	// Fully-qualified name of the metric (ex. kubecost_experimental_total_cost).
+	FullName string
+	Labels   prometheus.Labels
+}
+
+// Create the naming template data of a sample. The name of metrics without the
+// namespace and subsystem prefix (ex. other collectors) is the full name.
+func NewSinkName(v *viper.Viper, s Sample) SinkName {
+	n := SinkName{
+		Namespace: v.GetString("metrics.namespace"),
+		Subsystem: v.GetString("metrics.subsystem"),
+		Name:      s.Name,
+		FullName:  s.Name,
+		Labels:    s.Labels,
+	}
+	prefix := ""
+	for _, p := range []string{n.Namespace, n.Subsystem} {
+		if p != "" {
+			prefix += p + "_"
+		}
+	}
+	n.Name = strings.TrimPrefix(s.Name, prefix)
+	return n
+}
+
+// Parse a naming template from configuration, defaulting to text if empty.
+func ParseNameTemplate(v *viper.Viper, key, text string) (*template.Template, error) {
+	if t := v.GetString(key); t != "" {
+		text = t
+	}
+	tmpl, err := template.New(key).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse '%s' template: %w", key, err)
+	}
+	return tmpl, nil
+}
+
+// Execute a naming template.
+func ExecuteNameTemplate(tmpl *template.Template, n SinkName) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// StatsD and DogStatsD sink.
+//
+// After each cycle, the registry is gathered and each sample is sent to a
+// StatsD or DogStatsD server over UDP or a Unix domain socket, with tags
+// derived from its Prometheus labels. Lines are batched into packets of at
+// most "max_packet_size" bytes.
+//
+// For documentation on the DogStatsD datagram format, see the following:
+//   - https://docs.datadoghq.com/developers/dogstatsd/datagram_shell
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+// ErrFailedStatsD is returned when samples cannot be sent to the StatsD server.
+var ErrFailedStatsD = errors.New("Failed to send samples to StatsD server")
+
+// StatsD flavors.
+const (
+	// Tags are appended as "|#key:value,...".
+	StatsDFlavorDogStatsD = "dogstatsd"
+	// Tags are appended to the metric name as ",key=value,...", as supported
+	// by the Telegraf StatsD input.
+	StatsDFlavorStatsD = "statsd"
+)
+
+// Default maximum packet sizes. The UDP default fits in a 1500 byte MTU after
+// IP and UDP headers.
+const (
+	DefaultStatsDUDPPacketSize  = 1432
+	DefaultStatsDUnixPacketSize = 8192
+)
+
+// Replace characters reserved by the datagram format.
+var (
+	statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", " ", "_", "\n", "_")
+	statsdTagReplacer  = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_", "=", "_")
+)
+
+// Sanitize a metric name for use in a StatsD datagram.
+func SanitizeStatsDName(s string) string {
+	return statsdNameReplacer.Replace(s)
+}
+
+// Sanitize a tag key or value for use in a StatsD datagram. Colons are also
+// replaced in tag keys, since they separate keys from values.
+func SanitizeStatsDTag(s string, key bool) string {
+	s = statsdTagReplacer.Replace(s)
+	if key {
+		s = strings.ReplaceAll(s, ":", "_")
+	}
+	return s
+}
+
+// StatsDSink sends gathered samples to a StatsD server. It implements the
+// Recorder interface.
+type StatsDSink struct {
+	gatherer prometheus.Gatherer
+	network  string
+	address  string
+	conn     net.Conn
+	flavor   string
+	prefix   string
+	tags     []string
+	maxSize  int
+	// Previous values of counters by line prefix, since StatsD counters are
+	// deltas.
+	last map[string]float64
+}
+
+// Create a new StatsDSink from configuration. Samples are gathered from g.
+//
+// Addresses prefixed with "unix://" are Unix domain sockets (datagram).
+// Otherwise, the address is a UDP host:port.
+func NewStatsDSink(v *viper.Viper, g prometheus.Gatherer) (*StatsDSink, error) {
+	s := &StatsDSink{
+		gatherer: g,
+		network:  "udp",
+		address:  v.GetString("statsd.address"),
+		flavor:   v.GetString("statsd.flavor"),
+		prefix:   v.GetString("statsd.prefix"),
+		tags:     v.GetStringSlice("statsd.tags"),
+		maxSize:  v.GetInt("statsd.max_packet_size"),
+		last:     map[string]float64{},
+	}
+	if s.address == "" {
+		return nil, errors.New("'statsd.address' is required")
+	}
+	switch s.flavor {
+	case StatsDFlavorDogStatsD, StatsDFlavorStatsD:
+	case "":
+		s.flavor = StatsDFlavorDogStatsD
+	default:
+		return nil, fmt.Errorf("Unknown 'statsd.flavor' '%s'", s.flavor)
+	}
+	if strings.HasPrefix(s.address, "unix://") {
+		s.network, s.address = "unixgram", strings.TrimPrefix(s.address, "unix://")
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = DefaultStatsDUDPPacketSize
+		if s.network == "unixgram" {
+			s.maxSize = DefaultStatsDUnixPacketSize
+		}
+	}
+	return s, nil
+}
+
+// Format a sample as a StatsD line. Returns false if the sample should not be
+// sent (ex. a counter which did not change).
+//
+// Gauges and untyped metrics are sent as gauges. Counters are sent as the
+// difference from the previous value.
+func (s *StatsDSink) format(sample Sample) (string, bool) {
+	tags := make([]string, 0, len(sample.Labels)+len(s.tags))
+	tags = append(tags, s.tags...)
+	for _, n := range sample.LabelNames() {
+		v := sample.Labels[n]
+		if v == "" {
+			continue
+		}
+		if s.flavor == StatsDFlavorStatsD {
+			tags = append(tags, SanitizeStatsDTag(n, true)+"="+SanitizeStatsDTag(v, false))
+		} else {
+			tags = append(tags, SanitizeStatsDTag(n, true)+":"+SanitizeStatsDTag(v, false))
+		}
+	}
+	name := SanitizeStatsDName(s.prefix + sample.Name)
+	if s.flavor == StatsDFlavorStatsD && len(tags) > 0 {
+		name += "," + strings.Join(tags, ",")
+	}
+	value, typ := sample.Value, "g"
+	if sample.Type == dto.MetricType_COUNTER {
+		key := name + "|" + strings.Join(tags, ",")
+		prev, ok := s.last[key]
+		s.last[key] = sample.Value
+		if ok {
+			value = sample.Value - prev
+		}
+		if value == 0 {
+			return "", false
+		}
+		typ = "c"
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ
+	if s.flavor == StatsDFlavorDogStatsD && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line, true
+}
+
+// Batch lines into packets of at most maxSize bytes, separated by newlines.
+// Lines longer than maxSize are sent in their own packet.
+func BatchStatsDLines(lines []string, maxSize int) [][]byte {
+	packets := [][]byte{}
+	var cur []byte
+	for _, l := range lines {
+		if len(cur) > 0 && len(cur)+1+len(l) > maxSize {
+			packets = append(packets, cur)
+			cur = nil
+		}
+		if len(cur) > 0 {
+			cur = append(cur, '\n')
+		}
+		cur = append(cur, l...)
+	}
+	if len(cur) > 0 {
+		packets = append(packets, cur)
+	}
+	return packets
+}
+
+// Gather samples and send them to the StatsD server.
+//
+// The connection is established on first use, and re-established on the next
+// cycle after a write error.
+func (s *StatsDSink) Record(_ AllocationAPI, _ []Allocation) error {
+	samples, err := GatherSamples(s.gatherer)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFailedStatsD, err)
+	}
+	lines := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		if l, ok := s.format(sample); ok {
+			lines = append(lines, l)
+		}
+	}
+	if s.conn == nil {
+		if s.conn, err = net.Dial(s.network, s.address); err != nil {
+			s.conn = nil
+			return fmt.Errorf("%w: %v", ErrFailedStatsD, err)
+		}
+	}
+	for _, p := range BatchStatsDLines(lines, s.maxSize) {
+		if _, err := s.conn.Write(p); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("%w: %v", ErrFailedStatsD, err)
+		}
+	}
+	return nil
+}
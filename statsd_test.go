@@ -0,0 +1,119 @@
+// Copyright 2023 Infrable. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeStatsD(t *testing.T) {
+	assert.Equal(t, "kubecost_total_cost_a_b", SanitizeStatsDName("kubecost:total cost|a@b"))
+	assert.Equal(t, "app_kubernetes_io_name", SanitizeStatsDTag("app:kubernetes|io#name", true))
+	assert.Equal(t, "a:b_c_d", SanitizeStatsDTag("a:b,c=d", false))
+}
+
+func TestStatsDSinkFormat(t *testing.T) {
+	v := NewTestConfig([]byte(`statsd:
+  address: 127.0.0.1:8125
+  prefix: kubecost.
+  tags: ["env:prod"]`))
+	s, err := NewStatsDSink(v, prometheus.NewRegistry())
+	assert.NoError(t, err)
+	l, ok := s.format(Sample{Name: "total_cost", Type: dto.MetricType_GAUGE, Labels: prometheus.Labels{"namespace": "a,b", "pod": ""}, Value: 1.5})
+	assert.True(t, ok)
+	assert.Equal(t, "kubecost.total_cost:1.5|g|#env:prod,namespace:a_b", l)
+
+	// Counters are sent as deltas, and skipped if unchanged.
+	c := Sample{Name: "dropped_series_total", Type: dto.MetricType_COUNTER, Labels: prometheus.Labels{"metric": "x"}, Value: 3}
+	l, ok = s.format(c)
+	assert.True(t, ok)
+	assert.Equal(t, "kubecost.dropped_series_total:3|c|#env:prod,metric:x", l)
+	_, ok = s.format(c)
+	assert.False(t, ok)
+	c.Value = 5
+	l, _ = s.format(c)
+	assert.Equal(t, "kubecost.dropped_series_total:2|c|#env:prod,metric:x", l)
+
+	v.Set("statsd.flavor", StatsDFlavorStatsD)
+	v.Set("statsd.tags", []string{})
+	s, err = NewStatsDSink(v, prometheus.NewRegistry())
+	assert.NoError(t, err)
+	l, _ = s.format(Sample{Name: "total_cost", Type: dto.MetricType_GAUGE, Labels: prometheus.Labels{"namespace": "a"}, Value: 1})
+	assert.Equal(t, "kubecost.total_cost,namespace=a:1|g", l)
+
+	v.Set("statsd.flavor", "graphite")
+	_, err = NewStatsDSink(v, prometheus.NewRegistry())
+	assert.Error(t, err)
+}
+
+func TestBatchStatsDLines(t *testing.T) {
+	packets := BatchStatsDLines([]string{"aaaa", "bbbb", "cccc", strings.Repeat("d", 12)}, 10)
+	assert.Equal(t, [][]byte{[]byte("aaaa\nbbbb"), []byte("cccc"), []byte(strings.Repeat("d", 12))}, packets)
+	assert.Empty(t, BatchStatsDLines(nil, 10))
+}
+
+func TestStatsDSinkRecord(t *testing.T) {
+	r := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "total_cost"}, []string{"namespace"})
+	r.MustRegister(g)
+	for _, ns := range []string{"a", "b", "c"} {
+		g.WithLabelValues(ns).Set(1)
+	}
+
+	t.Run("udp", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer pc.Close()
+		v := NewTestConfig([]byte(`statsd:
+  address: ` + pc.LocalAddr().String() + `
+  max_packet_size: 56`))
+		s, err := NewStatsDSink(v, r)
+		assert.NoError(t, err)
+		assert.NoError(t, s.Record(nil, nil))
+		assert.Equal(t, []string{
+			"total_cost:1|g|#namespace:a\ntotal_cost:1|g|#namespace:b",
+			"total_cost:1|g|#namespace:c",
+		}, readPackets(t, pc, 2))
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dsd.socket")
+		pc, err := net.ListenPacket("unixgram", path)
+		assert.NoError(t, err)
+		defer pc.Close()
+		v := NewTestConfig([]byte(`statsd:
+  address: unix://` + path))
+		s, err := NewStatsDSink(v, r)
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultStatsDUnixPacketSize, s.maxSize)
+		assert.NoError(t, s.Record(nil, nil))
+		assert.Equal(t, []string{
+			"total_cost:1|g|#namespace:a\ntotal_cost:1|g|#namespace:b\ntotal_cost:1|g|#namespace:c",
+		}, readPackets(t, pc, 1))
+	})
+}
+
+// Read n packets from a listener.
+func readPackets(t *testing.T, pc net.PacketConn, n int) []string {
+	packets := []string{}
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		k, _, err := pc.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			break
+		}
+		packets = append(packets, string(buf[:k]))
+	}
+	return packets
+}
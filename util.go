@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Retrieve an element from a map using a dot-separated key.
@@ -156,3 +157,63 @@ func SortAndJoinMap(m map[string]any, sep string) string {
 	}
 	return strings.Join(elems, sep)
 }
+
+// Parse a duration string. In addition to the units accepted by
+// time.ParseDuration, the units "d" (day) and "w" (week) are accepted as a
+// suffix to an integer value (ex. 7d, 2w).
+//
+// # Example
+//
+//	func main() {
+//		d, _ := ParseDuration("7d")
+//		fmt.Printf("%v\n", d)
+//	}
+//
+//	Output:
+//	168h0m0s
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for u, d := range units {
+		if !strings.HasSuffix(s, u) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, u))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * d, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Join errors into a single error, whose message is the concatenation of
+// the messages of each error. Returns nil if there are no errors.
+//
+// The first error is wrapped, such that errors.Is and errors.As can be used
+// to examine it.
+func JoinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs)-1)
+	for i, err := range errs[1:] {
+		msgs[i] = err.Error()
+	}
+	if len(msgs) == 0 {
+		return errs[0]
+	}
+	return fmt.Errorf("%w; %s", errs[0], strings.Join(msgs, "; "))
+}
+
+// Whether the slice contains the element.
+func contains[T comparable](x []T, elem T) bool {
+	for _, v := range x {
+		if v == elem {
+			return true
+		}
+	}
+	return false
+}
@@ -5,7 +5,9 @@
 package main
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -168,3 +170,39 @@ func TestSortAndJoinMap(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "1m", want: time.Minute},
+		{s: "12h", want: 12 * time.Hour},
+		{s: "1d", want: 24 * time.Hour},
+		{s: "7d", want: 7 * 24 * time.Hour},
+		{s: "2w", want: 14 * 24 * time.Hour},
+		{s: "xd", wantErr: true},
+		{s: "bad value", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.s, func(t *testing.T) {
+			ret, err := ParseDuration(tc.s)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, ret)
+		})
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	assert.NoError(t, JoinErrors(nil))
+	assert.Equal(t, errA, JoinErrors([]error{errA}))
+	err := JoinErrors([]error{errA, errB, errors.New("c")})
+	assert.ErrorIs(t, err, errA)
+	assert.EqualError(t, err, "a; b; c")
+}